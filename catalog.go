@@ -0,0 +1,208 @@
+package udt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// CatalogMode is the kind of catalog a BASIC program is entered in
+type CatalogMode int
+
+const (
+	// CatalogGlobal copies the compiled program to the global catalog in UDTHOME, where it is
+	// available to every account
+	CatalogGlobal CatalogMode = iota
+	// CatalogLocal copies the compiled program to the account's CTLG directory and points a VOC
+	// entry at the copy
+	CatalogLocal
+	// CatalogDirect points a VOC entry at the compiled program in its program file, so recompiling
+	// the program updates the catalog
+	CatalogDirect
+)
+
+func (m CatalogMode) String() string {
+	switch m {
+	case CatalogGlobal:
+		return "global"
+	case CatalogLocal:
+		return "local"
+	case CatalogDirect:
+		return "direct"
+	}
+	return "unknown"
+}
+
+// keyword returns the CATALOG and DELETE.CATALOG option selecting the mode
+func (m CatalogMode) keyword() string {
+	switch m {
+	case CatalogLocal:
+		return " LOCAL"
+	case CatalogDirect:
+		return " DIRECT"
+	}
+	return ""
+}
+
+// CatalogEntry is a BASIC program in a catalog
+type CatalogEntry struct {
+	Name string
+	Mode CatalogMode
+
+	// Path is the compiled program the entry refers to. For local and direct entries it is as given
+	// in the VOC entry, which may be relative to the account.
+	Path string
+}
+
+var (
+	// catalogedRegex and catalogDeletedRegex match the messages UniData prints when a catalog
+	// operation succeeds, e.g. "SUB.A has been cataloged."
+	catalogedRegex      = regexp.MustCompile(`(?im)\bhas been cataloged\b[.!]?\s*$`)
+	catalogDeletedRegex = regexp.MustCompile(`(?im)\bhas been deleted\b[.!]?\s*$`)
+)
+
+// CatalogProgram enters a compiled BASIC program in a catalog under its own name, so that it can be
+// CALLed as a subroutine or run as a verb. An existing global entry is replaced.
+func (c *Client) CatalogProgram(progFile string, progName string, mode CatalogMode) error {
+	return c.CatalogProgramContext(context.Background(), progFile, progName, mode)
+}
+
+// CatalogProgramContext is like CatalogProgram but gives up if ctx is done first
+func (c *Client) CatalogProgramContext(ctx context.Context, progFile string, progName string, mode CatalogMode) error {
+
+	if progFile == "" {
+		return fmt.Errorf("progFile must not be blank")
+	}
+	if progName == "" {
+		return fmt.Errorf("progName must not be blank")
+	}
+
+	statement := "CATALOG " + progFile + " " + progName + mode.keyword()
+	if mode == CatalogGlobal {
+		statement += " FORCE"
+	}
+
+	if err := c.catalogStatement(ctx, statement, catalogedRegex); err != nil {
+		return fmt.Errorf("failed to catalog BASIC program %s %s: %w", progFile, progName, err)
+	}
+	return nil
+}
+
+// DeleteCatalog removes a program from a catalog. The compiled program in its program file is left
+// alone.
+func (c *Client) DeleteCatalog(progName string, mode CatalogMode) error {
+	return c.DeleteCatalogContext(context.Background(), progName, mode)
+}
+
+// DeleteCatalogContext is like DeleteCatalog but gives up if ctx is done first
+func (c *Client) DeleteCatalogContext(ctx context.Context, progName string, mode CatalogMode) error {
+
+	if progName == "" {
+		return fmt.Errorf("progName must not be blank")
+	}
+
+	if err := c.catalogStatement(ctx, "DELETE.CATALOG "+progName+mode.keyword(), catalogDeletedRegex); err != nil {
+		return fmt.Errorf("failed to delete %s catalog entry %s: %w", mode, progName, err)
+	}
+	return nil
+}
+
+// catalogStatement runs a catalog statement, which succeeded if its output matches success.
+// Otherwise the output is a *UniDataError, classified by ClassifyOutput where possible.
+func (c *Client) catalogStatement(ctx context.Context, statement string, success *regexp.Regexp) (err error) {
+
+	r, err := c.ExecutePhantomContext(ctx, statement)
+	if err != nil {
+		return err
+	}
+	defer safeClose(r, "failed to close catalog response reader", &err)
+
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if success.Match(buf) {
+		return nil
+	}
+	if uerr := ClassifyOutput(statement, buf); uerr != nil {
+		return uerr
+	}
+
+	// The message is unknown, so report the first line of it
+	msg := strings.TrimSpace(string(buf))
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		msg = strings.TrimSpace(msg[:i])
+	}
+	if msg == "" {
+		msg = "no output"
+	}
+	return &UniDataError{Message: msg, Statement: statement}
+}
+
+// ListCatalog returns the programs in the global catalog and the account's local and direct
+// catalogs. Global entries are found by listing the global catalog directory, local and direct ones
+// by querying the VOC for catalog entries. A VOC entry is reported as local when it refers to a
+// CTLG directory.
+func (c *Client) ListCatalog() ([]CatalogEntry, error) {
+	return c.ListCatalogContext(context.Background())
+}
+
+// ListCatalogContext is like ListCatalog but gives up if ctx is done first
+func (c *Client) ListCatalogContext(ctx context.Context) ([]CatalogEntry, error) {
+
+	var entries []CatalogEntry
+
+	ctlg := strings.TrimSuffix(c.env.UdtHome, "/") + "/sys/CTLG"
+	out, err := c.shellOutput(ctx, fmt.Sprintf(`cd %s 2>/dev/null || exit 0
+for f in */*; do [ -f "$f" ] && echo "$f"; done; true`, shellQuote(ctlg)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list global catalog: %w", err)
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
+		}
+		entries = append(entries, CatalogEntry{
+			Name: path.Base(line),
+			Mode: CatalogGlobal,
+			Path: ctlg + "/" + line,
+		})
+	}
+
+	results, err := NewQuery(`LIST VOC WITH F1 LIKE "C..." F2 TOXML`).RunContext(ctx, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list local catalog: %w", err)
+	}
+	defer results.Close()
+
+	for {
+		record, err := results.ReadRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list local catalog: %w", err)
+		}
+
+		name, _ := record["_ID"].(string)
+		progPath, _ := record["F2"].(string)
+		if name == "" {
+			continue
+		}
+
+		mode := CatalogDirect
+		if strings.Contains("/"+progPath, "/CTLG/") {
+			mode = CatalogLocal
+		}
+		entries = append(entries, CatalogEntry{Name: name, Mode: mode, Path: progPath})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
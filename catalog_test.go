@@ -0,0 +1,93 @@
+package udt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCatalogProgram(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	for _, name := range []string{"GLOBAL.SUB", "LOCAL.SUB", "DIRECT.SUB"} {
+		if err := c.CompileBasicProgram("BP", name, "RETURN"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, mode := range map[string]CatalogMode{
+		"GLOBAL.SUB": CatalogGlobal,
+		"LOCAL.SUB":  CatalogLocal,
+		"DIRECT.SUB": CatalogDirect,
+	} {
+		if err := c.CatalogProgram("BP", name, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := c.ListCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []CatalogEntry{
+		{Name: "DIRECT.SUB", Mode: CatalogDirect, Path: "BP/_DIRECT.SUB"},
+		{Name: "GLOBAL.SUB", Mode: CatalogGlobal, Path: env.UdtHome + "/sys/CTLG/g/GLOBAL.SUB"},
+		{Name: "LOCAL.SUB", Mode: CatalogLocal, Path: "CTLG/LOCAL.SUB"},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected:\n%+v\nreceived:\n%+v", expected, entries)
+	}
+
+	for _, e := range expected {
+		if err := c.DeleteCatalog(e.Name, e.Mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err = c.ListCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("unexpected entries: %+v", entries)
+	}
+	assertDirEmpty(t, env.UdtAcct+"/_PH_")
+}
+
+func TestCatalogProgramErrors(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	var uerr *UniDataError
+	err := c.CatalogProgram("BP", "MISSING", CatalogDirect)
+	if !errors.As(err, &uerr) || uerr.Message != "BP/_MISSING not found." {
+		t.Errorf("expected an error cataloging a program that hasn't been compiled, received %v", err)
+	}
+	err = c.DeleteCatalog("MISSING", CatalogGlobal)
+	if !errors.As(err, &uerr) || uerr.Message != "MISSING not cataloged." {
+		t.Errorf("expected an error deleting a program that isn't cataloged, received %v", err)
+	}
+	if err := c.CatalogProgram("BP", "", CatalogDirect); err == nil {
+		t.Error("expected an error for a blank program name")
+	}
+}
+
+func TestCatalogProgramErrorName(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	// A program name that looks like an error message doesn't make the catalog fail
+	if err := c.CompileBasicProgram("BP", "LOGERROR", "RETURN"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CatalogProgram("BP", "LOGERROR", CatalogDirect); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteCatalog("LOGERROR", CatalogDirect); err != nil {
+		t.Fatal(err)
+	}
+}
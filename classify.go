@@ -0,0 +1,186 @@
+package udt
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// classifyLines is how many non-blank lines at the start of a statement's output are checked
+	// for error messages. Later lines may be data, which can look like anything, and waiting for
+	// more lines would hold up output that is being streamed.
+	classifyLines = 1
+
+	// classifyPeekSize limits how much output is read looking for those lines
+	classifyPeekSize = 4096
+)
+
+// ErrorPattern recognises a UniData error message in the output of a statement
+type ErrorPattern struct {
+	// Pattern is matched against each line of output. If it has subexpressions named "code" and
+	// "message" they give the error number and message, otherwise the whole line is the message.
+	Pattern *regexp.Regexp
+
+	// Code is the error number when Pattern has no "code" subexpression
+	Code int
+}
+
+var (
+	errorPatternsMu sync.RWMutex
+	errorPatterns   = []ErrorPattern{
+		{Pattern: regexp.MustCompile(`^\s*(Not a verb|Verb not found)\b`)},
+		{Pattern: regexp.MustCompile(`^\s*(Not a filename|File not found|No file named|Open file error)\b`)},
+		{Pattern: regexp.MustCompile(`(?i)^\s*syntax error\b`)},
+		{Pattern: regexp.MustCompile(`^\s*\[(?P<code>\d+)\]\s*(?P<message>.+)`)},
+		{Pattern: regexp.MustCompile(`^\s*(?:ERROR|Error|error)\s+(?P<code>\d+)\s*:\s*(?P<message>.+)`)},
+	}
+)
+
+// RegisterErrorPattern adds a pattern to those recognised by ClassifyOutput. Patterns are tried in
+// the order they were registered, after the built in ones.
+func RegisterErrorPattern(p ErrorPattern) {
+	errorPatternsMu.Lock()
+	defer errorPatternsMu.Unlock()
+	errorPatterns = append(errorPatterns, p)
+}
+
+// ClassifyOutput returns a *UniDataError if the first non-blank line of output is a known UniData
+// error message, or nil if it isn't
+func ClassifyOutput(statement string, output []byte) *UniDataError {
+	errorPatternsMu.RLock()
+	defer errorPatternsMu.RUnlock()
+
+	s := bufio.NewScanner(bytes.NewReader(output))
+	for checked := 0; checked < classifyLines && s.Scan(); {
+		line := strings.TrimRight(s.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		checked++
+
+		for _, p := range errorPatterns {
+			match := p.Pattern.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+
+			e := &UniDataError{Code: p.Code, Message: strings.TrimSpace(line), Statement: statement}
+			for i, name := range p.Pattern.SubexpNames() {
+				switch name {
+				case "code":
+					if code, err := strconv.Atoi(match[i]); err == nil {
+						e.Code = code
+					}
+				case "message":
+					e.Message = strings.TrimSpace(match[i])
+				}
+			}
+			return e
+		}
+	}
+	return nil
+}
+
+// WithErrorDetection sets whether Execute, ExecutePhantom and Query.Run check the first line of a
+// statement's output for UniData error messages, see ClassifyOutput. ExecutePhantom and Query.Run
+// return the *UniDataError, while reading the Stdout of a process started by Execute fails with it.
+// It is enabled by default.
+func WithErrorDetection(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.detectErrors = enabled
+	}
+}
+
+// checkOutput returns a *UniDataError, closing r, if the first line of the statement's output is a
+// UniData error message. Otherwise it returns a reader over the whole of the output.
+func (c *Client) checkOutput(statement string, r io.ReadCloser) (io.ReadCloser, error) {
+	if !c.detectErrors {
+		return r, nil
+	}
+
+	head, err := readOutputHead(r)
+	if err != nil && err != io.EOF {
+		_ = r.Close()
+		return nil, err
+	}
+
+	if uerr := ClassifyOutput(statement, head); uerr != nil {
+		_ = r.Close()
+		return nil, uerr
+	}
+	return newHookedCloser(io.MultiReader(bytes.NewReader(head), r), r.Close), nil
+}
+
+// classifyReader returns a reader over the output of a running statement whose first read fails
+// with a *UniDataError if the output starts with a UniData error message
+func (c *Client) classifyReader(statement string, r io.Reader) io.Reader {
+	if !c.detectErrors {
+		return r
+	}
+	return &classifyingReader{r: r, statement: statement}
+}
+
+type classifyingReader struct {
+	r         io.Reader
+	statement string
+	checked   bool
+	head      []byte
+	err       error
+}
+
+func (r *classifyingReader) Read(p []byte) (int, error) {
+	if !r.checked {
+		r.checked = true
+		r.head, r.err = readOutputHead(r.r)
+		if uerr := ClassifyOutput(r.statement, r.head); uerr != nil {
+			r.head, r.err = nil, uerr
+		}
+	}
+
+	if len(r.head) > 0 {
+		n := copy(p, r.head)
+		r.head = r.head[n:]
+		return n, nil
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.r.Read(p)
+}
+
+// readOutputHead reads the start of a statement's output until it has the line ClassifyOutput
+// checks, without waiting for any more output than that
+func readOutputHead(r io.Reader) ([]byte, error) {
+	var head []byte
+	buf := make([]byte, classifyPeekSize)
+	for len(head) < classifyPeekSize && !hasClassifyLines(head) {
+		n, err := r.Read(buf[:classifyPeekSize-len(head)])
+		head = append(head, buf[:n]...)
+		if err != nil {
+			return head, err
+		}
+	}
+	return head, nil
+}
+
+// hasClassifyLines reports whether output contains the complete line checked by ClassifyOutput
+func hasClassifyLines(output []byte) bool {
+	lines := 0
+	for {
+		i := bytes.IndexByte(output, '\n')
+		if i < 0 {
+			return false
+		}
+		if len(bytes.TrimSpace(output[:i])) > 0 {
+			if lines++; lines == classifyLines {
+				return true
+			}
+		}
+		output = output[i+1:]
+	}
+}
@@ -0,0 +1,140 @@
+package udt
+
+import (
+	"errors"
+	"io/ioutil"
+	"regexp"
+	"testing"
+)
+
+func TestClassifyOutput(t *testing.T) {
+
+	tests := []struct {
+		output   string
+		expected *UniDataError
+	}{
+		{"Not a verb\nFOO\n", &UniDataError{Message: "Not a verb"}},
+		{"\nNot a filename :\nNOSUCHFILE\n", &UniDataError{Message: "Not a filename :"}},
+		{"syntax error\n", &UniDataError{Message: "syntax error"}},
+		{"[30107] Unable to open file NOSUCHFILE\r\n", &UniDataError{Code: 30107, Message: "Unable to open file NOSUCHFILE"}},
+		{"Error 42: out of cheese\n", &UniDataError{Code: 42, Message: "out of cheese"}},
+		// Messages only count at the start of a line
+		{"<NAME>Not a verb</NAME>\n", nil},
+		{"3 records listed\n", nil},
+		// Only the first line is checked, later ones may be data
+		{"\nLIST ORDERS NOTES\n[12] File not found\n", nil},
+		{"", nil},
+	}
+
+	for i, test := range tests {
+		if test.expected != nil {
+			test.expected.Statement = "STMT"
+		}
+		err := ClassifyOutput("STMT", []byte(test.output))
+		if (err == nil) != (test.expected == nil) || err != nil && *err != *test.expected {
+			t.Errorf("tests[%d]: expected %+v, received %+v", i, test.expected, err)
+		}
+	}
+}
+
+func TestRegisterErrorPattern(t *testing.T) {
+
+	// Leave the registry as it was, so the test can be run repeatedly
+	errorPatternsMu.Lock()
+	saved := errorPatterns
+	errorPatternsMu.Unlock()
+	defer func() {
+		errorPatternsMu.Lock()
+		errorPatterns = saved
+		errorPatternsMu.Unlock()
+	}()
+
+	if err := ClassifyOutput("STMT", []byte("Widget jammed\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	RegisterErrorPattern(ErrorPattern{Pattern: regexp.MustCompile(`^Widget jammed`), Code: 7})
+
+	err := ClassifyOutput("STMT", []byte("Widget jammed\n"))
+	if err == nil || err.Code != 7 || err.Message != "Widget jammed" {
+		t.Errorf("unexpected error: %+v", err)
+	}
+}
+
+func TestExecutePhantomUniDataError(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	_, err := c.ExecutePhantom("NOTAVERB")
+	var uerr *UniDataError
+	if !errors.As(err, &uerr) {
+		t.Fatalf("expected a *UniDataError, received %v", err)
+	}
+	if uerr.Statement != "NOTAVERB" || uerr.Message != "Not a verb" {
+		t.Errorf("unexpected error: %+v", uerr)
+	}
+
+	_, err = NewQuery("LIST NOSUCHFILE").Run(c)
+	if !errors.As(err, &uerr) {
+		t.Fatalf("expected a *UniDataError, received %v", err)
+	}
+	if uerr.Message != "Not a filename :" {
+		t.Errorf("unexpected error: %+v", uerr)
+	}
+
+	// The COMO files are cleaned up all the same
+	assertDirEmpty(t, env.UdtAcct+"/_PH_")
+
+	c, _, cleanup = newTestClient(t, WithErrorDetection(false))
+	defer cleanup()
+
+	r, err := c.ExecutePhantom("NOTAVERB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "Not a verb\nNOTAVERB\n" {
+		t.Errorf("unexpected output: %q", out)
+	}
+}
+
+func TestExecuteUniDataError(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	proc, err := c.Execute("NOTAVERB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	_, err = proc.Output()
+	var uerr *UniDataError
+	if !errors.As(err, &uerr) {
+		t.Fatalf("expected a *UniDataError, received %v", err)
+	}
+	if uerr.Statement != "NOTAVERB" || uerr.Message != "Not a verb" {
+		t.Errorf("unexpected error: %+v", uerr)
+	}
+
+	// Other output is passed through unchanged
+	proc, err = c.Execute("LIST ORDERS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	out, err := proc.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "LIST ORDERS\n" {
+		t.Errorf("unexpected output: %q", out)
+	}
+}
@@ -0,0 +1,250 @@
+package udt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-uuid"
+)
+
+// Severity is how serious a CompileDiagnostic is
+type Severity string
+
+const (
+	// SeverityError is a problem that stops the program compiling
+	SeverityError Severity = "error"
+	// SeverityWarning is a problem the compiler tolerates
+	SeverityWarning Severity = "warning"
+)
+
+// CompileDiagnostic is an error or warning reported by the BASIC compiler
+type CompileDiagnostic struct {
+	// Line and Column locate the problem in the source, counting from 1. They are 0 when the
+	// compiler didn't give a location.
+	Line     int
+	Column   int
+	Severity Severity
+	Message  string
+}
+
+func (d CompileDiagnostic) String() string {
+	switch {
+	case d.Line > 0 && d.Column > 0:
+		return fmt.Sprintf("%d:%d: %s: %s", d.Line, d.Column, d.Severity, d.Message)
+	case d.Line > 0:
+		return fmt.Sprintf("%d: %s: %s", d.Line, d.Severity, d.Message)
+	}
+	return fmt.Sprintf("%s: %s", d.Severity, d.Message)
+}
+
+var (
+	// compileLocationRegex matches the location of a diagnostic, optionally followed by its message:
+	// "Line 12", "Line 12, Column 5: message" or "Line 12, Position 5"
+	compileLocationRegex = regexp.MustCompile(`(?i)^Line\s+(\d+)(?:\s*,\s*(?:Col|Column|Pos|Position)\s+(\d+))?\s*[:,-]?\s*(.*)$`)
+
+	compileWarningRegex = regexp.MustCompile(`(?i)^Warning\s*:?\s*(.*)$`)
+
+	// compileErrorRegex matches the start of an error message: "main program: syntax error" or
+	// "Error: message"
+	compileErrorRegex = regexp.MustCompile(`(?i)^(?:main program|subroutine|function|error)\s*:\s*(.+)$`)
+
+	// compileStatusRegex matches the lines the compiler prints around its messages. They mention the
+	// program name, which may contain anything.
+	compileStatusRegex = regexp.MustCompile(`(?i)^(?:Compiling Unibasic:|compilation (?:finished|failed))`)
+)
+
+// parseCompileDiagnostics parses the output of the BASIC command. The compiler reports errors as a
+// message followed by a line giving its location:
+//
+//	main program: syntax error at or before
+//	Line 3, Column 5
+//
+// and warnings as "Warning: Line 7: message". A location line that doesn't follow a message is an
+// error in itself. Anything else, such as the "Compiling Unibasic: BP/NAME" header, is ignored.
+func parseCompileDiagnostics(output string) []CompileDiagnostic {
+	var diags []CompileDiagnostic
+
+	// awaitingLocation is set while the last diagnostic may still be followed by its location
+	awaitingLocation := false
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+
+		if match := compileLocationRegex.FindStringSubmatch(line); match != nil {
+			if awaitingLocation {
+				d := &diags[len(diags)-1]
+				d.Line, d.Column = parseLocation(match)
+				if match[3] != "" {
+					d.Message += " " + match[3]
+				}
+				awaitingLocation = false
+				continue
+			}
+			d := CompileDiagnostic{Severity: SeverityError, Message: match[3]}
+			d.Line, d.Column = parseLocation(match)
+			diags = append(diags, d)
+			continue
+		}
+
+		if match := compileWarningRegex.FindStringSubmatch(line); match != nil {
+			d := CompileDiagnostic{Severity: SeverityWarning, Message: match[1]}
+			if loc := compileLocationRegex.FindStringSubmatch(match[1]); loc != nil {
+				d.Line, d.Column = parseLocation(loc)
+				d.Message = loc[3]
+			}
+			diags = append(diags, d)
+			awaitingLocation = d.Line == 0
+			continue
+		}
+
+		if compileStatusRegex.MatchString(line) {
+			awaitingLocation = false
+			continue
+		}
+
+		if match := compileErrorRegex.FindStringSubmatch(line); match != nil {
+			diags = append(diags, CompileDiagnostic{Severity: SeverityError, Message: match[1]})
+			awaitingLocation = true
+			continue
+		}
+
+		if line != "" {
+			awaitingLocation = false
+		}
+	}
+	return diags
+}
+
+// parseLocation returns the line and column from a match of compileLocationRegex
+func parseLocation(match []string) (line, column int) {
+	line, _ = strconv.Atoi(match[1])
+	column, _ = strconv.Atoi(match[2])
+	return line, column
+}
+
+// OverwritePolicy decides what happens when uploading the source of a BASIC program that already
+// exists
+type OverwritePolicy int
+
+const (
+	// FailIfExists leaves the existing source alone and fails with ErrProgramExists
+	FailIfExists OverwritePolicy = iota
+	// Overwrite replaces the existing source once the new source has compiled
+	Overwrite
+	// BackupThenOverwrite replaces the existing source once the new source has compiled, keeping
+	// the existing source under a backup name
+	BackupThenOverwrite
+)
+
+// defaultBackupSuffix is appended to a program's name to name its backup
+const defaultBackupSuffix = ".bak"
+
+// UploadOptions control how the source of a BASIC program is uploaded for compiling. The zero value
+// refuses to replace existing source.
+type UploadOptions struct {
+	Overwrite OverwritePolicy
+
+	// BackupSuffix is appended to the program name to name the backup kept by BackupThenOverwrite.
+	// It defaults to ".bak". An existing backup is replaced.
+	BackupSuffix string
+}
+
+// sourceUpload is BASIC source that has been moved into place, along with the source it replaced,
+// until the compile either succeeds or fails
+type sourceUpload struct {
+	client     *Client
+	srcPath    string
+	origPath   string // the replaced source, blank if there wasn't any
+	backupPath string // where to keep the replaced source, blank to remove it
+}
+
+// uploadSource uploads program source under a temporary name and renames it into place, after moving
+// any existing source aside. The program file must be a directory-type file.
+func (c *Client) uploadSource(ctx context.Context, progFile string, progName string, src []byte, opts UploadOptions) (*sourceUpload, error) {
+
+	dir := c.env.UdtAcct + "/" + progFile
+	fi, err := c.transport.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find program file (%s): %w", dir, err)
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("program file %s is not a directory-type file", progFile)
+	}
+
+	u := &sourceUpload{client: c, srcPath: dir + "/" + progName}
+
+	_, err = c.transport.Stat(u.srcPath)
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to check for existing source (%s): %w", u.srcPath, err)
+	}
+	if exists && opts.Overwrite == FailIfExists {
+		return nil, fmt.Errorf("%s %s: %w", progFile, progName, ErrProgramExists)
+	}
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	tmpPath := u.srcPath + "." + id + ".tmp"
+	if err := c.writeFile(ctx, tmpPath, src); err != nil {
+		_ = c.transport.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to upload BASIC source: %w", err)
+	}
+
+	if exists {
+		u.origPath = u.srcPath + "." + id + ".orig"
+		if err := c.transport.Rename(u.srcPath, u.origPath); err != nil {
+			_ = c.transport.Remove(tmpPath)
+			return nil, fmt.Errorf("failed to move existing source aside (%s): %w", u.srcPath, err)
+		}
+		if opts.Overwrite == BackupThenOverwrite {
+			suffix := opts.BackupSuffix
+			if suffix == "" {
+				suffix = defaultBackupSuffix
+			}
+			u.backupPath = u.srcPath + suffix
+		}
+	}
+
+	if err := c.transport.Rename(tmpPath, u.srcPath); err != nil {
+		_ = c.transport.Remove(tmpPath)
+		if u.origPath != "" {
+			_ = c.transport.Rename(u.origPath, u.srcPath)
+		}
+		return nil, fmt.Errorf("failed to move BASIC source into place (%s): %w", u.srcPath, err)
+	}
+
+	return u, nil
+}
+
+// rollback puts back the source that was replaced, or removes the new source if there wasn't any
+func (u *sourceUpload) rollback() error {
+	if u.origPath == "" {
+		return u.client.transport.Remove(u.srcPath)
+	}
+	return u.client.transport.Rename(u.origPath, u.srcPath)
+}
+
+// commit backs up or removes the source that was replaced
+func (u *sourceUpload) commit() error {
+	if u.origPath == "" {
+		return nil
+	}
+	if u.backupPath != "" {
+		if err := u.client.transport.Rename(u.origPath, u.backupPath); err != nil {
+			return fmt.Errorf("failed to back up previous source (%s): %w", u.backupPath, err)
+		}
+		return nil
+	}
+	if err := u.client.transport.Remove(u.origPath); err != nil {
+		return fmt.Errorf("failed to remove previous source (%s): %w", u.origPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package udt
+
+import (
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCompileDiagnostics(t *testing.T) {
+
+	tests := []struct {
+		output   string
+		expected []CompileDiagnostic
+	}{
+		{"\nCompiling Unibasic: BP/X in mode 'u'.\ncompilation finished\n", nil},
+		{
+			"\nCompiling Unibasic: BP/X in mode 'u'.\nmain program: syntax error at or before\nLine 3, Column 5\ncompilation failed\n",
+			[]CompileDiagnostic{{Line: 3, Column: 5, Severity: SeverityError, Message: "syntax error at or before"}},
+		},
+		{
+			"Warning: Line 7: Variable X never assigned a value\nWarning: Variable Y never assigned a value\nLine 9\ncompilation finished\n",
+			[]CompileDiagnostic{
+				{Line: 7, Severity: SeverityWarning, Message: "Variable X never assigned a value"},
+				{Line: 9, Severity: SeverityWarning, Message: "Variable Y never assigned a value"},
+			},
+		},
+		{
+			"Line 12, Position 4: unexpected END\ncompilation failed\n",
+			[]CompileDiagnostic{{Line: 12, Column: 4, Severity: SeverityError, Message: "unexpected END"}},
+		},
+		{
+			"main program: error in expression\n\ncompilation failed\n",
+			[]CompileDiagnostic{{Severity: SeverityError, Message: "error in expression"}},
+		},
+		{"\nCompiling Unibasic: BP/ERROR.HANDLER in mode 'u'.\ncompilation finished\n", nil},
+		{"\nCompiling Unibasic: BP/X in mode 'u'.\nPRINT \"error\"\ncompilation finished\n", nil},
+		{
+			"\nCompiling Unibasic: BP/LOG.ERROR in mode 'u'.\nError: unterminated string\nLine 4\ncompilation failed\n",
+			[]CompileDiagnostic{{Line: 4, Severity: SeverityError, Message: "unterminated string"}},
+		},
+	}
+
+	for i, test := range tests {
+		diags := parseCompileDiagnostics(test.output)
+		if !reflect.DeepEqual(diags, test.expected) {
+			t.Errorf("tests[%d]:\nexpected: %+v\nreceived: %+v", i, test.expected, diags)
+		}
+	}
+}
+
+func TestCompileBasicProgramDiagnostics(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	diags, err := c.CompileBasicProgramDiagnostics("BP", "WARNS", "X = 1\nY = UNUSED\nRETURN\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []CompileDiagnostic{{Line: 2, Severity: SeverityWarning, Message: "Variable UNUSED never assigned a value"}}
+	if !reflect.DeepEqual(diags, expected) {
+		t.Errorf("expected %+v, received %+v", expected, diags)
+	}
+
+	_, err = c.CompileBasicProgramDiagnostics("BP", "FAILS", "X = 1\nY = UNUSED\n  SYNTAX\n")
+	var compileErr *CompileError
+	if !errors.As(err, &compileErr) {
+		t.Fatalf("expected a *CompileError, received %v", err)
+	}
+	expected = []CompileDiagnostic{
+		{Line: 2, Severity: SeverityWarning, Message: "Variable UNUSED never assigned a value"},
+		{Line: 3, Column: 3, Severity: SeverityError, Message: "syntax error at or before"},
+	}
+	if !reflect.DeepEqual(compileErr.Diagnostics, expected) {
+		t.Errorf("expected %+v, received %+v", expected, compileErr.Diagnostics)
+	}
+}
+
+func TestCompileBasicProgramUpload(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	bp := env.UdtAcct + "/BP"
+	source := func(name string) string {
+		t.Helper()
+		buf, err := ioutil.ReadFile(bp + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+	assertFiles := func(expected ...string) {
+		t.Helper()
+		entries, err := ioutil.ReadDir(bp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("expected files %v, found %v", expected, names)
+		}
+	}
+
+	if err := c.CompileBasicProgram("BP", "PROG", "V1\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The existing source is left alone by default
+	if err := c.CompileBasicProgram("BP", "PROG", "V2\n"); !errors.Is(err, ErrProgramExists) {
+		t.Fatalf("expected %v, received %v", ErrProgramExists, err)
+	}
+	if src := source("PROG"); src != "V1\n" {
+		t.Errorf("unexpected source: %q", src)
+	}
+
+	if _, err := c.CompileBasicProgramWithOptions("BP", "PROG", "V2\n", UploadOptions{Overwrite: Overwrite}); err != nil {
+		t.Fatal(err)
+	}
+	if src := source("PROG"); src != "V2\n" {
+		t.Errorf("unexpected source: %q", src)
+	}
+	assertFiles("PROG", "_PROG")
+
+	if _, err := c.CompileBasicProgramWithOptions("BP", "PROG", "V3\n", UploadOptions{Overwrite: BackupThenOverwrite}); err != nil {
+		t.Fatal(err)
+	}
+	if src := source("PROG.bak"); src != "V2\n" {
+		t.Errorf("unexpected backup: %q", src)
+	}
+	assertFiles("PROG", "PROG.bak", "_PROG")
+
+	// Source that fails to compile is rolled back
+	_, err := c.CompileBasicProgramWithOptions("BP", "PROG", "SYNTAX\n", UploadOptions{Overwrite: BackupThenOverwrite})
+	var compileErr *CompileError
+	if !errors.As(err, &compileErr) {
+		t.Fatalf("expected a *CompileError, received %v", err)
+	}
+	if src := source("PROG"); src != "V3\n" {
+		t.Errorf("source not restored: %q", src)
+	}
+	if src := source("PROG.bak"); src != "V2\n" {
+		t.Errorf("backup replaced: %q", src)
+	}
+	if err := c.CompileBasicProgram("BP", "NEW", "SYNTAX\n"); !errors.As(err, &compileErr) {
+		t.Fatalf("expected a *CompileError, received %v", err)
+	}
+	assertFiles("PROG", "PROG.bak", "_PROG")
+}
+
+func TestCompileBasicProgramNotDirectory(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	if err := ioutil.WriteFile(env.UdtAcct+"/HASHED", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := c.CompileBasicProgram("HASHED", "PROG", "RETURN\n")
+	if err == nil || !strings.Contains(err.Error(), "not a directory-type file") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := c.CompileBasicProgram("MISSING", "PROG", "RETURN\n"); err == nil {
+		t.Error("expected an error for a missing program file")
+	}
+}
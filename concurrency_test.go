@@ -0,0 +1,226 @@
+package udt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// concurrencyObserver tracks the peak number of commands and PHANTOM processes in flight
+type concurrencyObserver struct {
+	mu          sync.Mutex
+	commands    int
+	maxCommands int
+	phantoms    int
+	maxPhantoms int
+}
+
+func (o *concurrencyObserver) OpStart(ctx context.Context, ev *Event) context.Context {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	switch ev.Op {
+	case OpCommand:
+		if o.commands++; o.commands > o.maxCommands {
+			o.maxCommands = o.commands
+		}
+	case OpPhantomLaunch:
+		if o.phantoms++; o.phantoms > o.maxPhantoms {
+			o.maxPhantoms = o.phantoms
+		}
+	}
+	return ctx
+}
+
+func (o *concurrencyObserver) OpEnd(ctx context.Context, ev *Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	switch ev.Op {
+	case OpCommand:
+		o.commands--
+	case OpPhantomLaunch:
+		if ev.Err != nil {
+			o.phantoms--
+		}
+	case OpPhantomWait:
+		o.phantoms--
+	}
+}
+
+func TestClientConcurrentQueries(t *testing.T) {
+
+	const maxSessions = 2
+	const maxPhantoms = 1
+	const workers = 8
+
+	observer := &concurrencyObserver{}
+	c, env, cleanup := newTestClient(t, WithMaxSessions(maxSessions), WithMaxPhantoms(maxPhantoms), WithObserver(observer))
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	errc := make(chan error, 2*workers)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+			errc <- runTestQuery(c)
+		}()
+
+		go func(i int) {
+			defer wg.Done()
+			errc <- runTestPhantom(c, fmt.Sprintf("WHO %d", i))
+		}(i)
+	}
+
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if observer.maxCommands > maxSessions {
+		t.Errorf("expected at most %d concurrent commands, observed %d", maxSessions, observer.maxCommands)
+	}
+	if observer.maxPhantoms > maxPhantoms {
+		t.Errorf("expected at most %d concurrent PHANTOM processes, observed %d", maxPhantoms, observer.maxPhantoms)
+	}
+
+	assertDirEmpty(t, env.UdtAcct+"/BP")
+	assertDirEmpty(t, env.UdtAcct+"/_PH_")
+	assertDirEmpty(t, env.UdtAcct+"/_XML_")
+}
+
+func runTestQuery(c *Client) (err error) {
+	q, err := NewQueryBatched(c, &QueryConfig{
+		Select:    []string{"SELECT ORDERS"},
+		File:      "ORDERS",
+		Fields:    []string{"ID"},
+		BatchSize: 2,
+	})
+	if err != nil {
+		return err
+	}
+	defer safeClose(q, "failed to close query", &err)
+
+	for i := 1; ; i++ {
+		record, err := q.ReadRecord()
+		if err == io.EOF {
+			if i != 6 {
+				return fmt.Errorf("expected 5 records, received %d", i-1)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if record["ID"] != fmt.Sprint(i) {
+			return fmt.Errorf("unexpected record %d: %q", i, record)
+		}
+	}
+}
+
+func runTestPhantom(c *Client, statement string) (err error) {
+	r, err := c.ExecutePhantom(statement)
+	if err != nil {
+		return err
+	}
+	defer safeClose(r, "failed to close output", &err)
+
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if string(out) != statement+"\n" {
+		return fmt.Errorf("unexpected PHANTOM output: %q", out)
+	}
+	return nil
+}
+
+func TestClientMaxSessionsContext(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t, WithMaxSessions(1))
+	defer cleanup()
+
+	// Hold the only session
+	proc, err := c.Execute("WHAT")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.ExecuteContext(ctx, "WHAT"); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v while waiting for a session, received %v", context.DeadlineExceeded, err)
+	}
+
+	if _, err := ioutil.ReadAll(proc.Stdout); err != nil {
+		t.Fatal(err)
+	}
+	if err := proc.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The session has been freed
+	proc, err = c.Execute("WHAT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc.Close()
+}
+
+func TestSemaphoreFIFO(t *testing.T) {
+
+	s := newSemaphore(1)
+	if err := s.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	const waiters = 5
+	order := make(chan int, waiters)
+
+	for i := 0; i < waiters; i++ {
+		go func(i int) {
+			if err := s.acquire(context.Background()); err != nil {
+				t.Error(err)
+				return
+			}
+			order <- i
+			s.release()
+		}(i)
+
+		// Wait for the goroutine to queue before starting the next one
+		for queued(s) != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// A waiter that gives up leaves the queue without holding up the others
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.acquire(ctx); err != context.Canceled {
+		t.Fatalf("expected %v, received %v", context.Canceled, err)
+	}
+
+	s.release()
+
+	for i := 0; i < waiters; i++ {
+		if got := <-order; got != i {
+			t.Fatalf("expected waiter %d to acquire the semaphore, waiter %d did", i, got)
+		}
+	}
+}
+
+func queued(s *semaphore) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.waiters.Len()
+}
@@ -11,7 +11,7 @@ import (
 	"syscall"
 
 	"github.com/samhug/udt"
-	"golang.org/x/crypto/ssh"
+	"github.com/samhug/udt/sshconfig"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
@@ -22,27 +22,71 @@ func main() {
 	udtBinPtr := flag.String("udtbin", "/usr/udthome/bin", "$UDTBIN dir")
 	udtHomePtr := flag.String("udthome", "/usr/udthome", "$UDTHOME dir")
 	udtAcctPtr := flag.String("udtacct", "/usr/udthome/demo", "UDT account dir")
+	keyPtr := flag.String("key", "", "Private key file, password authentication is used if blank")
+	knownHostsPtr := flag.String("known_hosts", "~/.ssh/known_hosts", "known_hosts file used to verify the server")
+	jumpPtr := flag.String("jump", "", "Jump hosts to connect through, as in ssh -J")
+	insecurePtr := flag.Bool("insecure", false, "Skip host key verification (testing only)")
+	urlPtr := flag.String("url", "", "Connection URL, e.g. udt://user@host/usr/udthome/demo?udthome=/usr/udthome")
+	profilesPtr := flag.String("profiles", "", "Profile file (YAML or TOML)")
+	profilePtr := flag.String("profile", "", "Profile name, defaults to the profile file's default")
 
 	flag.Parse()
 
+	if *urlPtr != "" || *profilesPtr != "" {
+		var c *udt.Client
+		var err error
+		if *urlPtr != "" {
+			c, err = udt.Open(*urlPtr)
+		} else {
+			c, err = udt.OpenProfile(*profilesPtr, *profilePtr)
+		}
+		if err != nil {
+			fmt.Printf("unable to connect: %s", err)
+			return
+		}
+		defer c.Close()
+
+		runDemos(c)
+		return
+	}
+
 	if *hostPtr == "" {
 		flag.Usage()
 		return
 	}
 
-	username, password := getCredentials()
-
-	sshConfig := &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	sshCfg := &sshconfig.Config{
+		KnownHostsFiles:       []string{*knownHostsPtr},
+		InsecureIgnoreHostKey: *insecurePtr,
+		ProxyJump:             *jumpPtr,
 	}
+	if *keyPtr != "" {
+		sshCfg.User = getUsername()
+		sshCfg.KeyFiles = []string{*keyPtr}
+	} else {
+		sshCfg.User, sshCfg.Password = getCredentials()
+	}
+
+	defer sshCfg.Close()
 
 	addr := fmt.Sprintf("%s:%d", *hostPtr, *portPtr)
 
-	sshClient, err := ssh.Dial("tcp", addr, sshConfig)
+	sshConfig, err := sshCfg.ClientConfig(addr)
+	if err != nil {
+		fmt.Printf("invalid SSH configuration: %s", err)
+		return
+	}
+	dial, err := sshCfg.Dialer()
+	if err != nil {
+		fmt.Printf("invalid SSH configuration: %s", err)
+		return
+	}
+
+	transport, err := udt.DialSSHTransport(&udt.SSHDialConfig{
+		Addr:         addr,
+		ClientConfig: sshConfig,
+		Dial:         dial,
+	})
 	if err != nil {
 		fmt.Printf("SSH unable to connect: %s", err)
 		return
@@ -54,8 +98,17 @@ func main() {
 		UdtAcct: *udtAcctPtr,
 	}
 
-	c := udt.NewClient(sshClient, envConfig)
+	c, err := udt.NewClient(transport, envConfig)
+	if err != nil {
+		fmt.Printf("unable to create UDT client: %s", err)
+		return
+	}
+	defer c.Close()
+
+	runDemos(c)
+}
 
+func runDemos(c *udt.Client) {
 	demoRaw(c, "WHAT")
 	//demoRaw(c, "LIST DICT STUDENT")
 	//demoRaw(c, "LIST STUDENT LNAME CGA TOXML SAMPLE 1")
@@ -68,7 +121,6 @@ func main() {
 		Fields:    []string{"ID", "ORD_DATE", "ORD_TIME"},
 		BatchSize: 25,
 	})
-
 }
 
 func demoRaw(c *udt.Client, statement string) {
@@ -151,17 +203,23 @@ func demoQueryBatched(c *udt.Client, queryCfg *udt.QueryConfig) {
 	}
 }
 
-// From https://stackoverflow.com/a/32768479/2069095
-func getCredentials() (string, string) {
+func getUsername() string {
 	reader := bufio.NewReader(os.Stdin)
 
 	fmt.Print("Enter Username: ")
 	username, _ := reader.ReadString('\n')
 
+	return strings.TrimSpace(username)
+}
+
+// From https://stackoverflow.com/a/32768479/2069095
+func getCredentials() (string, string) {
+	username := getUsername()
+
 	fmt.Print("Enter Password: ")
 	bytePassword, _ := terminal.ReadPassword(int(syscall.Stdin))
 	password := string(bytePassword)
 	fmt.Println()
 
-	return strings.TrimSpace(username), strings.TrimSpace(password)
+	return username, strings.TrimSpace(password)
 }
@@ -0,0 +1,211 @@
+package udt
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// envConfigFiles are system configuration files that may set UDTHOME and UDTBIN, in the form of
+// shell variable assignments
+var envConfigFiles = []string{
+	"/etc/unidata",
+	"/etc/unidata.conf",
+	"/etc/default/unidata",
+}
+
+// DiscoverEnv fills in the blank fields of env by probing the database host, then checks that the
+// result describes a usable Unidata environment. env itself is not modified.
+//
+// UdtHome and UdtBin are taken, in order of preference, from the UDTHOME and UDTBIN environment
+// variables, from assignments in /etc/unidata-style configuration files, and from the location of
+// the udt binary on the PATH. Either is derived from the other when only one is found. UdtAcct
+// defaults to the login directory if it holds a VOC file, and otherwise to the single account
+// listed in UDTHOME's ud_database file.
+//
+// A problem with any of the fields is reported as an *EnvError.
+func DiscoverEnv(ctx context.Context, transport Transport, env *EnvConfig) (*EnvConfig, error) {
+	c := &Client{
+		transport: transport,
+		logger:    nopLogger{},
+		observer:  nopObserver{},
+	}
+	return c.discoverEnv(ctx, env)
+}
+
+func (c *Client) discoverEnv(ctx context.Context, env *EnvConfig) (*EnvConfig, error) {
+
+	found := &EnvConfig{}
+	if env != nil {
+		*found = *env
+	}
+
+	if found.UdtHome == "" || found.UdtBin == "" || found.UdtAcct == "" {
+		if err := c.probeEnv(ctx, found); err != nil {
+			return nil, err
+		}
+	}
+
+	if found.UdtHome == "" {
+		return nil, &EnvError{Field: "UdtHome", Reason: "UDTHOME is not set, no configuration file sets it and udt is not on the PATH"}
+	}
+	if found.UdtBin == "" {
+		found.UdtBin = path.Join(found.UdtHome, "bin")
+	}
+
+	if err := c.validateEnv(ctx, found); err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+// envAssignSed returns a sed command that prints key=value for an assignment to the shell variable
+// name, optionally exported. The value is unquoted and ends at whitespace or a semicolon, so
+// 'export UDTHOME="/usr/ud82"; ...' prints key=/usr/ud82.
+func envAssignSed(name string, key string) string {
+	return `s/^[[:space:]]*\(export[[:space:]]\{1,\}\)\{0,1\}` + name + `=["']\{0,1\}\([^"';[:space:]]*\).*/` + key + `=\2/p`
+}
+
+// probeEnv fills in the blank fields of env from what it can learn about the host's environment
+func (c *Client) probeEnv(ctx context.Context, env *EnvConfig) error {
+
+	script := `echo "env_home=$UDTHOME"
+echo "env_bin=$UDTBIN"
+for f in ` + shellJoin(envConfigFiles...) + `; do
+	[ -r "$f" ] && sed -n -e ` + shellQuote(envAssignSed("UDTHOME", "conf_home")) + ` -e ` + shellQuote(envAssignSed("UDTBIN", "conf_bin")) + ` "$f"
+done
+echo "which=$(command -v udt)"
+echo "login=$HOME"
+[ -f "$HOME/VOC" ] && echo "login_voc=1"
+exit 0`
+
+	out, err := c.shellOutput(ctx, script)
+	if err != nil {
+		return fmt.Errorf("failed to probe the Unidata environment: %w", err)
+	}
+	facts := parseProbeOutput(out)
+
+	// The first value found for each of UDTHOME and UDTBIN wins
+	firstOf := func(keys ...string) string {
+		for _, k := range keys {
+			if v := facts[k]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	home := firstOf("env_home", "conf_home")
+	bin := firstOf("env_bin", "conf_bin")
+	if which := facts["which"]; strings.HasPrefix(which, "/") {
+		if bin == "" {
+			bin = path.Dir(which)
+		}
+		if home == "" {
+			home = path.Dir(path.Dir(which))
+		}
+	}
+	if home == "" && bin != "" {
+		home = path.Dir(bin)
+	}
+
+	if env.UdtHome == "" {
+		env.UdtHome = home
+	}
+	if env.UdtBin == "" {
+		env.UdtBin = bin
+	}
+	if env.UdtAcct == "" && facts["login_voc"] != "" {
+		env.UdtAcct = facts["login"]
+	}
+
+	return nil
+}
+
+// validateEnv checks that env describes a usable Unidata environment. If env.UdtAcct is blank it is
+// looked up in UDTHOME's ud_database file.
+func (c *Client) validateEnv(ctx context.Context, env *EnvConfig) error {
+
+	script := fmt.Sprintf(`home=%s; bin=%s; acct=%s
+[ -d "$home" ] && echo "home_ok=1"
+[ -x "$bin/udt" ] && echo "bin_ok=1"
+if [ -n "$acct" ]; then
+	[ -d "$acct" ] && echo "acct_ok=1"
+	[ -f "$acct/VOC" ] && echo "voc_ok=1"
+else
+	for f in "$home/ud_database" "$home/include/ud_database"; do
+		[ -r "$f" ] || continue
+		for p in $(sed -n 's/^[[:space:]]*\(\/[^[:space:]]*\).*/\1/p' "$f"); do
+			[ -f "$p/VOC" ] && echo "account=$p"
+		done
+	done
+fi
+exit 0`, shellQuote(env.UdtHome), shellQuote(env.UdtBin), shellQuote(env.UdtAcct))
+
+	out, err := c.shellOutput(ctx, script)
+	if err != nil {
+		return fmt.Errorf("failed to validate the Unidata environment: %w", err)
+	}
+	facts := parseProbeOutput(out)
+
+	if facts["home_ok"] == "" {
+		return &EnvError{Field: "UdtHome", Value: env.UdtHome, Reason: "directory does not exist"}
+	}
+	if facts["bin_ok"] == "" {
+		return &EnvError{Field: "UdtBin", Value: env.UdtBin, Reason: "does not contain an executable udt binary"}
+	}
+
+	if env.UdtAcct == "" {
+		accounts := probeValues(out, "account")
+		switch len(accounts) {
+		case 0:
+			return &EnvError{Field: "UdtAcct", Reason: "the login directory is not an account and ud_database lists no accounts"}
+		case 1:
+			env.UdtAcct = accounts[0]
+			return nil
+		default:
+			return &EnvError{Field: "UdtAcct", Reason: fmt.Sprintf("ud_database lists several accounts, choose one of: %s", strings.Join(accounts, ", "))}
+		}
+	}
+
+	if facts["acct_ok"] == "" {
+		return &EnvError{Field: "UdtAcct", Value: env.UdtAcct, Reason: "directory does not exist"}
+	}
+	if facts["voc_ok"] == "" {
+		return &EnvError{Field: "UdtAcct", Value: env.UdtAcct, Reason: "directory has no VOC file, it is not a Unidata account"}
+	}
+
+	return nil
+}
+
+// parseProbeOutput parses key=value lines into a map. The first value of a key wins and quotes
+// around values are removed.
+func parseProbeOutput(out string) map[string]string {
+	facts := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if _, ok := facts[kv[0]]; ok && facts[kv[0]] != "" {
+			continue
+		}
+		facts[kv[0]] = strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+	}
+	return facts
+}
+
+// probeValues returns every value of key in key=value lines
+func probeValues(out string, key string) []string {
+	var values []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, key+"=") {
+			values = append(values, line[len(key)+1:])
+		}
+	}
+	return values
+}
@@ -0,0 +1,163 @@
+package udt
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setenv sets environment variables for the duration of a test. The returned function restores
+// their previous values.
+func setenv(t *testing.T, kv map[string]string) func() {
+	t.Helper()
+
+	type saved struct {
+		value string
+		ok    bool
+	}
+	prev := make(map[string]saved)
+	for k, v := range kv {
+		old, ok := os.LookupEnv(k)
+		prev[k] = saved{old, ok}
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return func() {
+		for k, s := range prev {
+			if s.ok {
+				os.Setenv(k, s.value)
+			} else {
+				os.Unsetenv(k)
+			}
+		}
+	}
+}
+
+func TestDiscoverEnv(t *testing.T) {
+
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+
+	tests := []struct {
+		name string
+		vars map[string]string
+		env  *EnvConfig
+	}{
+		{
+			name: "environment variables and login account",
+			vars: map[string]string{"UDTHOME": env.UdtHome, "UDTBIN": "", "HOME": env.UdtAcct},
+			env:  nil,
+		},
+		{
+			name: "udt on the PATH",
+			vars: map[string]string{"UDTHOME": "", "UDTBIN": "", "PATH": env.UdtBin + ":" + os.Getenv("PATH")},
+			env:  &EnvConfig{UdtAcct: env.UdtAcct},
+		},
+		{
+			name: "account from ud_database",
+			vars: map[string]string{"UDTHOME": env.UdtHome, "UDTBIN": env.UdtBin, "HOME": env.UdtHome},
+			env:  &EnvConfig{},
+		},
+	}
+
+	udDatabase := filepath.Join(env.UdtHome, "ud_database")
+	if err := ioutil.WriteFile(udDatabase, []byte("# accounts\n"+env.UdtAcct+"\n"+env.UdtHome+"/missing\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		restore := setenv(t, test.vars)
+		found, err := DiscoverEnv(context.Background(), NewLocalTransport(), test.env)
+		restore()
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if *found != *env {
+			t.Errorf("%s:\nexpected: %+v\nreceived: %+v", test.name, env, found)
+		}
+	}
+}
+
+func TestDiscoverEnvConfigFile(t *testing.T) {
+
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+
+	restore := setenv(t, map[string]string{"UDTHOME": "", "UDTBIN": "", "HOME": env.UdtAcct, "PATH": "/usr/bin:/bin"})
+	defer restore()
+
+	confFile := filepath.Join(env.UdtHome, "unidata.conf")
+	defer func(files []string) { envConfigFiles = files }(envConfigFiles)
+	envConfigFiles = []string{confFile}
+
+	tests := []string{
+		"UDTHOME=" + env.UdtHome + "\n",
+		"  export UDTHOME=" + env.UdtHome + "\n",
+		"UDTHOME=" + env.UdtHome + "; export UDTHOME\n",
+		"UDTHOME=" + env.UdtHome + " # the default install\n",
+		"UDTHOME=\"" + env.UdtHome + "\"\nexport UDTHOME\n",
+		"export UDTHOME='" + env.UdtHome + "'; export UDTBIN=\"" + env.UdtBin + "\";\n",
+		"UDTBIN=" + env.UdtBin + "\tUDTHOME=/elsewhere\n",
+	}
+
+	for _, conf := range tests {
+		if err := ioutil.WriteFile(confFile, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		found, err := DiscoverEnv(context.Background(), NewLocalTransport(), nil)
+		if err != nil {
+			t.Errorf("%q: %s", conf, err)
+			continue
+		}
+		if *found != *env {
+			t.Errorf("%q:\nexpected: %+v\nreceived: %+v", conf, env, found)
+		}
+	}
+}
+
+func TestDiscoverEnvErrors(t *testing.T) {
+
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+
+	restore := setenv(t, map[string]string{"UDTHOME": "", "UDTBIN": "", "HOME": env.UdtHome, "PATH": "/usr/bin:/bin"})
+	defer restore()
+
+	other := filepath.Join(env.UdtHome, "other")
+	if err := os.MkdirAll(other, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		env   *EnvConfig
+		field string
+	}{
+		{"no UDTHOME", &EnvConfig{UdtAcct: env.UdtAcct}, "UdtHome"},
+		{"missing UDTHOME", &EnvConfig{UdtHome: env.UdtHome + "/missing", UdtAcct: env.UdtAcct}, "UdtHome"},
+		{"no udt binary", &EnvConfig{UdtHome: env.UdtHome, UdtBin: env.UdtAcct, UdtAcct: env.UdtAcct}, "UdtBin"},
+		{"no account", &EnvConfig{UdtHome: env.UdtHome}, "UdtAcct"},
+		{"missing account", &EnvConfig{UdtHome: env.UdtHome, UdtAcct: env.UdtHome + "/missing"}, "UdtAcct"},
+		{"account without VOC", &EnvConfig{UdtHome: env.UdtHome, UdtAcct: other}, "UdtAcct"},
+	}
+
+	for _, test := range tests {
+		_, err := DiscoverEnv(context.Background(), NewLocalTransport(), test.env)
+
+		var envErr *EnvError
+		if !errors.As(err, &envErr) {
+			t.Errorf("%s: expected an *EnvError, received %v", test.name, err)
+			continue
+		}
+		if envErr.Field != test.field {
+			t.Errorf("%s: expected an error for %s, received %v", test.name, test.field, err)
+		}
+	}
+}
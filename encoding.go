@@ -0,0 +1,139 @@
+package udt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// defaultResultsEncoding is used to decode XML results when no encoding has been configured
+var defaultResultsEncoding encoding.Encoding = charmap.ISO8859_1
+
+// WithEncoding sets the character encoding used by the database, e.g. unicode.UTF8 for an account
+// running with NLS in UTF-8 mode or charmap.Windows1252. Statements are encoded with it before being
+// sent, and the output of Execute, RetrieveOutput, FollowPhantom, Session and JobManager as well as
+// XML results are decoded to UTF-8 with it. See AutoEncoding for detecting the encoding of XML
+// results.
+//
+// Without an encoding statements and output are passed through unchanged, and XML results are
+// decoded as ISO-8859-1.
+func WithEncoding(enc encoding.Encoding) ClientOption {
+	return func(c *Client) {
+		c.encoding = enc
+	}
+}
+
+// AutoEncoding returns an encoding that decodes XML results using the encoding declared in their
+// prolog (<?xml version="1.0" encoding="UTF-8"?>). Everything else, including XML without a
+// declaration, is encoded and decoded using fallback.
+func AutoEncoding(fallback encoding.Encoding) encoding.Encoding {
+	return &autoEncoding{fallback}
+}
+
+type autoEncoding struct {
+	encoding.Encoding
+}
+
+func (e *autoEncoding) String() string {
+	return fmt.Sprintf("auto (%s)", e.Encoding)
+}
+
+// LookupEncoding returns the encoding with the given IANA name or alias, such as "UTF-8",
+// "ISO-8859-15" or "windows-1252". "auto" returns AutoEncoding with an ISO-8859-1 fallback, and
+// "auto:<name>" AutoEncoding with the named fallback.
+func LookupEncoding(name string) (encoding.Encoding, error) {
+	if name == "auto" {
+		return AutoEncoding(defaultResultsEncoding), nil
+	}
+	if strings.HasPrefix(name, "auto:") {
+		fallback, err := LookupEncoding(strings.TrimPrefix(name, "auto:"))
+		if err != nil {
+			return nil, err
+		}
+		return AutoEncoding(fallback), nil
+	}
+
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("unsupported encoding: %s", name)
+	}
+	return enc, nil
+}
+
+// xmlEncodingRegex matches the encoding declaration of an XML prolog
+var xmlEncodingRegex = regexp.MustCompile(`^\s*<\?xml\s[^>]*?encoding\s*=\s*["']([A-Za-z0-9._:-]+)["']`)
+
+// xmlPrologMax is how much of an XML document is searched for its encoding declaration
+const xmlPrologMax = 256
+
+// detectXMLEncoding returns the encoding declared in the prolog at the start of r, and a reader
+// over the whole of r. A missing declaration gives fallback.
+func detectXMLEncoding(r io.Reader, fallback encoding.Encoding) (io.Reader, encoding.Encoding, error) {
+	br := bufio.NewReaderSize(r, xmlPrologMax)
+	prolog, _ := br.Peek(xmlPrologMax)
+
+	match := xmlEncodingRegex.FindSubmatch(prolog)
+	if match == nil {
+		return br, fallback, nil
+	}
+	enc, err := LookupEncoding(string(match[1]))
+	if err != nil {
+		return br, nil, fmt.Errorf("XML results declare an %s", err)
+	}
+	return br, enc, nil
+}
+
+// decodeReader decodes output read from the database host with the client's encoding
+func (c *Client) decodeReader(r io.Reader) io.Reader {
+	if c.encoding == nil || c.encoding == unicode.UTF8 {
+		return r
+	}
+	return c.encoding.NewDecoder().Reader(r)
+}
+
+// encodeWriter encodes input written to the database host with the client's encoding
+func (c *Client) encodeWriter(w io.WriteCloser) io.WriteCloser {
+	if c.encoding == nil || c.encoding == unicode.UTF8 {
+		return w
+	}
+	tw := transform.NewWriter(w, c.encoding.NewEncoder())
+	return newHookedWriteCloser(tw, func() error {
+		if err := tw.Close(); err != nil {
+			_ = w.Close()
+			return err
+		}
+		return w.Close()
+	})
+}
+
+// encodeString encodes a statement or program source with the client's encoding, failing if it
+// contains characters the encoding can't represent
+func (c *Client) encodeString(s string) (string, error) {
+	if c.encoding == nil {
+		return s, nil
+	}
+	encoded, err := c.encoding.NewEncoder().String(s)
+	if err != nil {
+		return "", fmt.Errorf("%q can't be encoded as %s: %w", s, c.encoding, err)
+	}
+	return encoded, nil
+}
+
+// resultsEncoding returns the encoding of XML results, which may be overridden for a query
+func (c *Client) resultsEncoding(override encoding.Encoding) encoding.Encoding {
+	if override != nil {
+		return override
+	}
+	if c.encoding != nil {
+		return c.encoding
+	}
+	return defaultResultsEncoding
+}
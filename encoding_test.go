@@ -0,0 +1,131 @@
+package udt
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestNewResultsEncoding(t *testing.T) {
+
+	tests := []struct {
+		xml      string
+		enc      encoding.Encoding
+		expected string
+	}{
+		{"<?xml version=\"1.0\"?>\n<ROOT><R><NAME>Caf\xe9</NAME></R></ROOT>", charmap.ISO8859_1, "Café"},
+		{"<?xml version=\"1.0\"?>\n<ROOT><R><NAME>Caf\xc3\xa9</NAME></R></ROOT>", unicode.UTF8, "Café"},
+		{"<?xml version=\"1.0\"?>\n<ROOT><R><NAME>\x80</NAME></R></ROOT>", charmap.Windows1252, "€"},
+		// The prolog's declaration is used, or the fallback without one
+		{"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<ROOT><R><NAME>Caf\xc3\xa9</NAME></R></ROOT>", AutoEncoding(charmap.ISO8859_1), "Café"},
+		{"<?xml version='1.0' encoding='windows-1252'?>\n<ROOT><R><NAME>\x80</NAME></R></ROOT>", AutoEncoding(unicode.UTF8), "€"},
+		{"<?xml version=\"1.0\"?>\n<ROOT><R><NAME>Caf\xe9</NAME></R></ROOT>", AutoEncoding(charmap.ISO8859_1), "Café"},
+		// A declaration no longer stops the XML decoder
+		{"<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n<ROOT><R><NAME>Caf\xe9</NAME></R></ROOT>", charmap.ISO8859_1, "Café"},
+	}
+
+	for i, test := range tests {
+		r := NewResultsEncoding(ioutil.NopCloser(strings.NewReader(test.xml)), test.enc)
+		record, err := r.ReadRecord()
+		if err != nil {
+			t.Errorf("tests[%d]: %s", i, err)
+			continue
+		}
+		if record["NAME"] != test.expected {
+			t.Errorf("tests[%d]: expected %q, received %q", i, test.expected, record["NAME"])
+		}
+	}
+
+	r := NewResultsEncoding(ioutil.NopCloser(strings.NewReader(`<?xml version="1.0" encoding="x-unknown"?><ROOT/>`)), AutoEncoding(unicode.UTF8))
+	if _, err := r.ReadRecord(); err == nil || !strings.Contains(err.Error(), "x-unknown") {
+		t.Errorf("expected an unsupported encoding error, received %v", err)
+	}
+}
+
+func TestLookupEncoding(t *testing.T) {
+
+	for name, expected := range map[string]encoding.Encoding{
+		"UTF-8":        unicode.UTF8,
+		"ISO-8859-1":   charmap.ISO8859_1,
+		"ISO-8859-15":  charmap.ISO8859_15,
+		"windows-1252": charmap.Windows1252,
+		"windows-1250": charmap.Windows1250,
+	} {
+		enc, err := LookupEncoding(name)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if enc != expected {
+			t.Errorf("%s: unexpected encoding %s", name, enc)
+		}
+	}
+
+	enc, err := LookupEncoding("auto:UTF-8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auto, ok := enc.(*autoEncoding); !ok || auto.Encoding != unicode.UTF8 {
+		t.Errorf("unexpected encoding %s", enc)
+	}
+
+	if _, err := LookupEncoding("x-unknown"); err == nil {
+		t.Error("expected an error for an unknown encoding")
+	}
+}
+
+func TestExecuteEncoding(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t, WithEncoding(charmap.Windows1252))
+	defer cleanup()
+
+	// The statement reaches udt encoded
+	proc, err := c.Execute("BYTES é€")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := proc.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "e980\n" {
+		t.Errorf("unexpected bytes: %q", out)
+	}
+
+	// and its output is decoded
+	for _, run := range []func() (string, error){
+		func() (string, error) {
+			proc, err := c.Execute("Café €5")
+			if err != nil {
+				return "", err
+			}
+			out, err := proc.Output()
+			return string(out), err
+		},
+		func() (string, error) {
+			r, err := c.ExecutePhantom("Café €5")
+			if err != nil {
+				return "", err
+			}
+			defer r.Close()
+			out, err := ioutil.ReadAll(r)
+			return string(out), err
+		},
+	} {
+		out, err := run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != "Café €5\n" {
+			t.Errorf("unexpected output: %q", out)
+		}
+	}
+
+	if _, err := c.Execute("日本"); err == nil {
+		t.Error("expected an error for a statement that can't be encoded")
+	}
+}
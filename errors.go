@@ -0,0 +1,147 @@
+package udt
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrPhantomStartParse is returned when udt's response to launching a PHANTOM process can't be
+// parsed. It is wrapped in a *CommandError holding the response.
+var ErrPhantomStartParse = errors.New("unable to parse PHANTOM start response")
+
+// ErrPhantomIncomplete is returned when a PHANTOM process exits without writing the trailer that
+// marks the end of its COMO file, e.g. because it was killed. The COMO file is left in place.
+var ErrPhantomIncomplete = errors.New("PHANTOM process exited without completing its COMO file")
+
+// ErrProgramExists is returned when uploading BASIC source over an existing program without
+// permission to overwrite it, see UploadOptions
+var ErrProgramExists = errors.New("BASIC program already exists")
+
+// ErrSavedListNotFound is returned when deleting a saved list that doesn't exist, which DELETELIST
+// reports as "'<name>' not found."
+var ErrSavedListNotFound = errors.New("saved list not found")
+
+// CommandError is returned when a command run on the database host fails or responds unexpectedly
+type CommandError struct {
+	Command string
+	Output  string
+	Err     error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("command '%s' failed: %s\n===\n%s", e.Command, e.Err, e.Output)
+}
+
+// Unwrap returns the underlying error
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// AgentError is returned by QueryBatched when its agent program prints a message that can't be
+// acted on, such as a SELECTED message without a record count or a RESULTBATCH message naming a
+// file outside the _XML_ directory
+type AgentError struct {
+	QueryID string
+	Line    string
+	Err     error
+}
+
+func (e *AgentError) Error() string {
+	return fmt.Sprintf("unusable message from QueryBatched agent %s: %s\n===\n%s", e.QueryID, e.Err, e.Line)
+}
+
+// Unwrap returns the underlying error
+func (e *AgentError) Unwrap() error {
+	return e.Err
+}
+
+// CompileError is returned when a BASIC program fails to compile
+type CompileError struct {
+	ProgFile string
+	ProgName string
+	Output   string
+
+	// Diagnostics are the errors and warnings parsed from Output
+	Diagnostics []CompileDiagnostic
+}
+
+func (e *CompileError) Error() string {
+	return fmt.Sprintf("failed to compile BASIC program %s %s:\n%s", e.ProgFile, e.ProgName, e.Output)
+}
+
+// ConnectionLostError is returned by operations that were in flight when the connection to the
+// database host was lost
+type ConnectionLostError struct {
+	Err error
+}
+
+func (e *ConnectionLostError) Error() string {
+	return fmt.Sprintf("connection to database host lost: %s", e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ConnectionLostError) Unwrap() error {
+	return e.Err
+}
+
+// EnvError is returned when a field of an EnvConfig can't be discovered or doesn't describe a
+// usable Unidata environment
+type EnvError struct {
+	Field  string // UdtHome, UdtBin or UdtAcct
+	Value  string
+	Reason string
+}
+
+func (e *EnvError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("invalid Unidata environment, %s: %s", e.Field, e.Reason)
+	}
+	return fmt.Sprintf("invalid Unidata environment, %s '%s': %s", e.Field, e.Value, e.Reason)
+}
+
+// UnexpectedPromptError is returned when a process answered by UdtProc.Respond waits for input at
+// a prompt that none of the rules match
+type UnexpectedPromptError struct {
+	Prompt string
+}
+
+func (e *UnexpectedPromptError) Error() string {
+	return fmt.Sprintf("unexpected prompt: %q", e.Prompt)
+}
+
+// ExitError is returned by UdtProc.Wait when udt exits with a non-zero status
+type ExitError struct {
+	ExitCode int
+
+	// Stderr holds the standard error output of the process when the error is returned by
+	// UdtProc.Output
+	Stderr []byte
+
+	Err error
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("udt exited with status %d", e.ExitCode)
+}
+
+// Unwrap returns the underlying error
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// UniDataError is returned when the output of a statement is a UniData error message rather than
+// the statement's result, e.g. "Not a verb" or "Not a filename". See ClassifyOutput.
+type UniDataError struct {
+	// Code is the error number given in the message, or that of the ErrorPattern that recognised
+	// it. It is 0 for messages without a number.
+	Code      int
+	Message   string
+	Statement string
+}
+
+func (e *UniDataError) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("statement '%s' failed: [%d] %s", e.Statement, e.Code, e.Message)
+	}
+	return fmt.Sprintf("statement '%s' failed: %s", e.Statement, e.Message)
+}
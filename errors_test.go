@@ -0,0 +1,111 @@
+package udt
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPhantomStartParseError(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	_, err := c.ExecutePhantom("NOSTART")
+	if !errors.Is(err, ErrPhantomStartParse) {
+		t.Fatalf("expected %v, received %v", ErrPhantomStartParse, err)
+	}
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("expected a *CommandError, received %T", err)
+	}
+	if !strings.Contains(cmdErr.Output, "Unable to start PHANTOM process.") {
+		t.Errorf("expected the command's output, received %q", cmdErr.Output)
+	}
+}
+
+func TestCommandError(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	_, err := c.shellOutput(context.Background(), "echo partial; exit 3")
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("expected a *CommandError, received %v", err)
+	}
+	if cmdErr.Output != "partial\n" {
+		t.Errorf("expected the command's stdout, received %q", cmdErr.Output)
+	}
+	if status, ok := exitStatus(errors.Unwrap(err)); !ok || status != 3 {
+		t.Errorf("expected exit status 3, received %v", cmdErr.Err)
+	}
+}
+
+func TestSavedListDelete(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	// Without a SAVEDLISTS file the failure mentions something not being found, but not the list
+	err := c.SavedListDelete("LIST1")
+	if err == nil || errors.Is(err, ErrSavedListNotFound) {
+		t.Errorf("expected an unexpected response error, received %v", err)
+	}
+
+	dir := filepath.Join(env.UdtAcct, "SAVEDLISTS")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "LIST1000"), []byte("1\n2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.SavedListDelete("LIST1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "LIST1000")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the saved list to be deleted, received %v", err)
+	}
+
+	if err := c.SavedListDelete("LIST1"); !errors.Is(err, ErrSavedListNotFound) {
+		t.Errorf("expected %v, received %v", ErrSavedListNotFound, err)
+	}
+	assertDirEmpty(t, env.UdtAcct+"/_PH_")
+}
+
+func TestQueryBatchedAgentError(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	for _, file := range []string{"BAD.SELECTED", "BAD.COUNT", "BAD.BATCH", "BAD.PATH"} {
+		err := func() error {
+			q, err := NewQueryBatched(c, &QueryConfig{File: file, Fields: []string{"ID"}, BatchSize: 2})
+			if err != nil {
+				return err
+			}
+			defer q.Close()
+			_, err = q.ReadRecord()
+			return err
+		}()
+
+		var agentErr *AgentError
+		if !errors.As(err, &agentErr) {
+			t.Errorf("%s: expected an *AgentError, received %v", file, err)
+			continue
+		}
+		if !strings.HasPrefix(agentErr.Line, "|") {
+			t.Errorf("%s: expected the agent's message, received %q", file, agentErr.Line)
+		}
+		var numErr *strconv.NumError
+		if file == "BAD.COUNT" && !errors.As(err, &numErr) {
+			t.Errorf("%s: expected a *strconv.NumError, received %v", file, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package udt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/samhug/udt/truncatereader"
+)
+
+// FollowPhantom returns a reader that follows the output of a running PHANTOM process as it is
+// written to the COMO file, like tail -f. The reader reaches EOF once the process completes, with
+// the completion trailer removed, and fails with ErrPhantomIncomplete if the process exits without
+// completing. FollowPhantom takes the place of WaitPhantom and RetrieveOutput.
+//
+// As the trailer can't be recognised until it has been written in full, the last few bytes written
+// by the process are held back until it writes more or completes.
+//
+// Closing the reader removes the COMO file. If the process hasn't completed by then it is killed.
+func (c *Client) FollowPhantom(proc *PhantomProc) (io.ReadCloser, error) {
+	return c.FollowPhantomContext(context.Background(), proc)
+}
+
+// FollowPhantomContext is like FollowPhantom but reads from the returned reader fail once ctx is
+// done. The PHANTOM process is killed when the reader is closed if it hasn't completed.
+func (c *Client) FollowPhantomContext(ctx context.Context, proc *PhantomProc) (_ io.ReadCloser, err error) {
+
+	if err := ctx.Err(); err != nil {
+		c.abandonPhantom(proc)
+		c.releasePhantom(proc)
+		return nil, err
+	}
+
+	ctx, obs := c.startOp(ctx, OpPhantomWait, strconv.Itoa(proc.Pid))
+
+	waitCtx, cancel := ctx, context.CancelFunc(func() {})
+	if c.phantomTimeout > 0 {
+		waitCtx, cancel = context.WithTimeout(ctx, c.phantomTimeout)
+	}
+
+	f := &comoFollower{
+		client:  c,
+		ctx:     ctx,
+		waitCtx: waitCtx,
+		proc:    proc,
+		obs:     obs,
+	}
+
+	f.f, err = f.open()
+	if err != nil {
+		f.finish(err)
+		cancel()
+		c.abandonPhantom(proc)
+		return nil, fmt.Errorf("failed to open UDT output file (%s): %w", proc.OutFile, err)
+	}
+	f.r = newContextReader(ctx, f.f)
+
+	r := c.decodeReader(truncatereader.NewTruncReader(f, []byte(phantomTrailer(proc.Pid)+"\n")))
+
+	return newHookedCloser(r, func() (err error) {
+		defer cancel()
+
+		closeErr := f.f.Close()
+		if !f.completed {
+			f.finish(errors.New("closed before the PHANTOM process completed"))
+			c.abandonPhantom(proc)
+			return closeErr
+		}
+
+		if closeErr != nil {
+			return fmt.Errorf("error closing UDT output file: %s", closeErr)
+		}
+		if err = c.transport.Remove(proc.OutFile); err != nil {
+			return fmt.Errorf("error removing temporary COMO file (%s): %w", proc.OutFile, err)
+		}
+		return nil
+	}), nil
+}
+
+// comoFollower reads a COMO file as it grows until its PHANTOM process completes
+type comoFollower struct {
+	client *Client
+	proc   *PhantomProc
+	obs    *observation
+	f      io.ReadCloser
+	r      io.Reader // f, failing once ctx is done
+
+	// waitCtx is ctx limited by the client's PHANTOM timeout
+	ctx     context.Context
+	waitCtx context.Context
+
+	// completed is set once the process has completed, after which the rest of the file is read
+	completed  bool
+	finishOnce sync.Once
+}
+
+// open opens the COMO file, waiting for it to be created if necessary
+func (f *comoFollower) open() (io.ReadCloser, error) {
+	for {
+		r, err := f.client.openFile(f.waitCtx, f.proc.OutFile)
+		if err == nil {
+			return r, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		if err := f.state(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (f *comoFollower) Read(p []byte) (int, error) {
+	for {
+		n, err := f.r.Read(p)
+		if n > 0 || (err != nil && err != io.EOF) {
+			return n, err
+		}
+
+		// We've caught up with the process
+		if f.completed {
+			return 0, io.EOF
+		}
+		if err := f.state(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// state checks on the PHANTOM process, sleeping for the poll interval if it is still running
+func (f *comoFollower) state() error {
+	state, err := f.client.phantomState(f.waitCtx, f.proc)
+	if err != nil {
+		if f.waitCtx.Err() != nil {
+			return f.giveUp()
+		}
+		err = fmt.Errorf("error waiting for process to terminate: %w", err)
+		f.finish(err)
+		return err
+	}
+
+	switch state {
+	case phantomCompleted:
+		f.completed = true
+		f.finish(nil)
+	case phantomExited:
+		err := fmt.Errorf("PHANTOM process %d: %w", f.proc.Pid, ErrPhantomIncomplete)
+		f.finish(err)
+		return err
+	case phantomRunning:
+		select {
+		case <-time.After(f.client.phantomPollInterval):
+		case <-f.waitCtx.Done():
+			return f.giveUp()
+		}
+	}
+	return nil
+}
+
+// giveUp ends the wait once waitCtx is done. The process is killed when the reader is closed.
+func (f *comoFollower) giveUp() error {
+	err := f.ctx.Err()
+	if err == nil {
+		err = fmt.Errorf("PHANTOM process %d did not complete within %s: %w", f.proc.Pid, f.client.phantomTimeout, f.waitCtx.Err())
+	}
+	f.finish(err)
+	return err
+}
+
+// finish ends the wait, freeing the process's phantoms slot
+func (f *comoFollower) finish(err error) {
+	f.finishOnce.Do(func() {
+		f.obs.end(err)
+		f.client.releasePhantom(f.proc)
+	})
+}
@@ -0,0 +1,150 @@
+package udt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestFollowPhantom(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	proc, err := c.ExecutePhantomAsync("TICK 15")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.FollowPhantom(proc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Output is available while the process is still running
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "tick 1\n" {
+		t.Errorf("unexpected first line: %q", line)
+	}
+	if !processRunning(proc.Pid) {
+		t.Errorf("PHANTOM process %d has already exited", proc.Pid)
+	}
+
+	// The rest of the output follows once it completes, without the trailer
+	rest, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ""
+	for i := 2; i <= 15; i++ {
+		expected += fmt.Sprintf("tick %d\n", i)
+	}
+	if string(rest) != expected {
+		t.Errorf("unexpected output: %q", rest)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertDirEmpty(t, env.UdtAcct+"/_PH_")
+}
+
+func TestFollowPhantomIncomplete(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	proc, err := c.ExecutePhantomAsync("CRASH")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.FollowPhantom(proc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.ReadAll(r)
+	if !errors.Is(err, ErrPhantomIncomplete) {
+		t.Fatalf("expected %v, received %v", ErrPhantomIncomplete, err)
+	}
+	if string(out) != "crashing\n" {
+		t.Errorf("unexpected output: %q", out)
+	}
+
+	_ = r.Close()
+	assertDirEmpty(t, env.UdtAcct+"/_PH_")
+}
+
+func TestFollowPhantomClose(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	proc, err := c.ExecutePhantomAsync("SLEEP 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.FollowPhantom(proc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bufio.NewReader(r).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing before the process completes kills it
+	_ = r.Close()
+	if processRunning(proc.Pid) {
+		t.Errorf("PHANTOM process %d is still running", proc.Pid)
+	}
+	assertDirEmpty(t, env.UdtAcct+"/_PH_")
+}
+
+func TestFollowPhantomCancel(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	// Far more output than is read ahead of the caller
+	statement := strings.Repeat("ECHO ", 4000)
+	proc, err := c.ExecutePhantomAsync(statement)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r, err := c.FollowPhantomContext(ctx, proc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads fail once ctx is done, even though there is more output waiting in the COMO file
+	cancel()
+	rest, err := ioutil.ReadAll(r)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, received %v", context.Canceled, err)
+	}
+	if len(buf)+len(rest) >= len(statement) {
+		t.Errorf("expected reading to stop with output still waiting, read %d bytes", len(buf)+len(rest))
+	}
+
+	_ = r.Close()
+	assertDirEmpty(t, env.UdtAcct+"/_PH_")
+}
@@ -3,9 +3,11 @@ module github.com/samhug/udt
 go 1.14
 
 require (
+	github.com/BurntSushi/toml v0.4.1
 	github.com/hashicorp/go-uuid v1.0.2
 	github.com/pkg/sftp v1.13.4
 	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 	golang.org/x/sys v0.0.0-20211029165221-6e7872819dc8 // indirect
 	golang.org/x/text v0.3.7
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,546 @@
+package udt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/samhug/udt/truncatereader"
+)
+
+// errJobManagerClosed is returned when using a JobManager that has been closed
+var errJobManagerClosed = errors.New("job manager has been closed")
+
+// JobStatus is the state of a Job
+type JobStatus string
+
+const (
+	// JobQueued is a job waiting to be launched, see JobManager
+	JobQueued JobStatus = "queued"
+	// JobRunning is a job whose PHANTOM process has been launched
+	JobRunning JobStatus = "running"
+	// JobSucceeded is a job whose PHANTOM process completed. Its output is in the JobStore.
+	JobSucceeded JobStatus = "succeeded"
+	// JobFailed is a job whose PHANTOM process couldn't be launched or exited without completing.
+	// Any output it wrote is in the JobStore.
+	JobFailed JobStatus = "failed"
+)
+
+// Job is a statement run as a PHANTOM process by a JobManager
+type Job struct {
+	ID      string    `json:"id"`
+	Command string    `json:"command"`
+	Status  JobStatus `json:"status"`
+
+	// Pid and OutFile identify the PHANTOM process once the job is running. ProcStart is the start
+	// time of the process as reported by ps, which tells it apart from a later process given the
+	// same pid. It is blank if the process couldn't be found straight after launching it.
+	Pid       int    `json:"pid,omitempty"`
+	OutFile   string `json:"out_file,omitempty"`
+	ProcStart string `json:"proc_start,omitempty"`
+
+	Submitted time.Time `json:"submitted"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+
+	// Error describes why a job failed
+	Error string `json:"error,omitempty"`
+}
+
+// Done reports whether the job has succeeded or failed
+func (j *Job) Done() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed
+}
+
+// JobStore persists the state and output of the jobs of a JobManager. Implementations must be safe
+// for concurrent use.
+type JobStore interface {
+	// Load returns every job that has been saved
+	Load() ([]*Job, error)
+
+	// Save creates or replaces the saved state of a job
+	Save(job *Job) error
+
+	// CreateOutput creates or truncates the stored output of a job
+	CreateOutput(id string) (io.WriteCloser, error)
+
+	// OpenOutput opens the stored output of a job for reading
+	OpenOutput(id string) (io.ReadCloser, error)
+}
+
+// FileJobStore is a JobStore that keeps each job in a directory on the local filesystem, its state
+// in <id>.json and its output in <id>.out
+type FileJobStore struct {
+	dir string
+}
+
+// NewFileJobStore returns a FileJobStore in dir, creating the directory if necessary
+func NewFileJobStore(dir string) (*FileJobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create job store directory: %w", err)
+	}
+	return &FileJobStore{dir: dir}, nil
+}
+
+// Load returns every job in the directory
+func (s *FileJobStore) Load() ([]*Job, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*Job, 0, len(paths))
+	for _, path := range paths {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		job := &Job{}
+		if err := json.Unmarshal(buf, job); err != nil {
+			return nil, fmt.Errorf("failed to parse job (%s): %w", path, err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// Save writes the job's state to a temporary file and renames it into place, so a crash leaves
+// either the old or the new state
+func (s *FileJobStore) Save(job *Job) error {
+	buf, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, job.ID+".json")
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// CreateOutput creates the job's .out file
+func (s *FileJobStore) CreateOutput(id string) (io.WriteCloser, error) {
+	return os.Create(filepath.Join(s.dir, id+".out"))
+}
+
+// OpenOutput opens the job's .out file
+func (s *FileJobStore) OpenOutput(id string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, id+".out"))
+}
+
+// JobManager runs statements as PHANTOM processes, keeping track of them in a JobStore so they
+// survive a restart of the program. A new JobManager on the same store picks up where the last one
+// left off: it relaunches queued jobs and re-attaches to running ones, collecting their output once
+// they complete.
+//
+// Jobs are launched in the order they were submitted, each waiting in the queue for a free slot
+// when the client's number of PHANTOM processes is limited by WithMaxPhantoms. A job that has been
+// re-attached to holds a slot just like one launched by this JobManager.
+//
+// A job whose PHANTOM process was launched just as the previous JobManager stopped may not have been
+// recorded as running, in which case it is launched again.
+type JobManager struct {
+	client *Client
+	store  JobStore
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// queued is signalled when a job is added to the queue
+	queued chan struct{}
+
+	mu       sync.Mutex
+	jobs     map[string]*Job
+	done     map[string]chan struct{}
+	queue    []*Job
+	closed   bool
+	storeErr error
+}
+
+// NewJobManager returns a JobManager that runs jobs with c, resuming the jobs in store. Progress is
+// checked at the client's PHANTOM poll interval, its PHANTOM timeout doesn't apply to jobs.
+func NewJobManager(c *Client, store JobStore) (*JobManager, error) {
+
+	jobs, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load jobs: %w", err)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Submitted.Before(jobs[j].Submitted) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &JobManager{
+		client: c,
+		store:  store,
+		ctx:    ctx,
+		cancel: cancel,
+		queued: make(chan struct{}, 1),
+		jobs:   make(map[string]*Job, len(jobs)),
+		done:   make(map[string]chan struct{}),
+	}
+
+	for _, job := range jobs {
+		m.jobs[job.ID] = job
+
+		switch job.Status {
+		case JobQueued:
+			m.done[job.ID] = make(chan struct{})
+			m.queue = append(m.queue, job)
+		case JobRunning:
+			m.done[job.ID] = make(chan struct{})
+			m.wg.Add(1)
+			go m.resume(*job)
+		}
+	}
+
+	m.wg.Add(1)
+	go m.launch()
+
+	return m, nil
+}
+
+// Submit queues statement to be run as a PHANTOM process and returns the new job
+func (m *JobManager) Submit(statement string) (Job, error) {
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return Job{}, err
+	}
+	job := &Job{
+		ID:        id,
+		Command:   statement,
+		Status:    JobQueued,
+		Submitted: time.Now(),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return Job{}, errJobManagerClosed
+	}
+	if err := m.store.Save(job); err != nil {
+		return Job{}, fmt.Errorf("failed to save job: %w", err)
+	}
+
+	m.jobs[id] = job
+	m.done[id] = make(chan struct{})
+	m.queue = append(m.queue, job)
+
+	select {
+	case m.queued <- struct{}{}:
+	default:
+	}
+
+	return *job, nil
+}
+
+// Job returns the current state of the job with the given ID
+func (m *JobManager) Job(id string) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Jobs returns the current state of every job, in the order they were submitted
+func (m *JobManager) Jobs() []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	jobs := make([]Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Submitted.Before(jobs[j].Submitted) })
+	return jobs
+}
+
+// Wait blocks until the job with the given ID has succeeded or failed and returns its final state
+func (m *JobManager) Wait(id string) (Job, error) {
+	return m.WaitContext(context.Background(), id)
+}
+
+// WaitContext is like Wait but gives up if ctx is done. The job carries on regardless.
+func (m *JobManager) WaitContext(ctx context.Context, id string) (Job, error) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	done := m.done[id]
+	m.mu.Unlock()
+
+	if !ok {
+		return Job{}, fmt.Errorf("unknown job: %s", id)
+	}
+	if done != nil {
+		select {
+		case <-done:
+		case <-m.ctx.Done():
+			return Job{}, errJobManagerClosed
+		case <-ctx.Done():
+			return Job{}, ctx.Err()
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return *job, nil
+}
+
+// Output opens the output of a finished job. The caller must close it.
+func (m *JobManager) Output(id string) (io.ReadCloser, error) {
+	return m.store.OpenOutput(id)
+}
+
+// Close stops launching and tracking jobs, leaving running PHANTOM processes to carry on so a later
+// JobManager can re-attach to them. It returns the first error encountered saving the state of a
+// job in the background.
+func (m *JobManager) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+
+	m.cancel()
+	m.wg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.storeErr
+}
+
+// launch launches queued jobs one at a time, in the order they were queued, until the JobManager
+// is closed. Launching waits for a free phantoms slot.
+func (m *JobManager) launch() {
+	defer m.wg.Done()
+
+	for {
+		m.mu.Lock()
+		if len(m.queue) == 0 {
+			m.mu.Unlock()
+			select {
+			case <-m.queued:
+				continue
+			case <-m.ctx.Done():
+				return
+			}
+		}
+		job := m.queue[0]
+		m.queue = m.queue[1:]
+		id, statement := job.ID, job.Command
+		m.mu.Unlock()
+
+		proc, err := m.client.ExecutePhantomAsyncContext(m.ctx, statement)
+		if err != nil {
+			if m.ctx.Err() != nil {
+				// Closed before it launched, leave it queued
+				return
+			}
+			m.finish(id, JobFailed, fmt.Errorf("failed to launch PHANTOM process: %w", err))
+			continue
+		}
+
+		// An error leaves the start time blank, so the job is re-attached to by pid alone
+		procStart, _ := m.procStart(proc.Pid)
+
+		m.update(id, func(job *Job) {
+			job.Status = JobRunning
+			job.Pid = proc.Pid
+			job.OutFile = proc.OutFile
+			job.ProcStart = procStart
+			job.Started = time.Now()
+		})
+
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			defer m.client.releasePhantom(proc)
+			m.follow(id, proc, phantomRunning)
+		}()
+	}
+}
+
+// resume re-attaches to a job that was running when the last JobManager stopped
+func (m *JobManager) resume(job Job) {
+	defer m.wg.Done()
+
+	proc := &PhantomProc{Pid: job.Pid, OutFile: job.OutFile}
+	if err := m.client.holdPhantom(m.ctx, proc); err != nil {
+		return
+	}
+	defer m.client.releasePhantom(proc)
+
+	for {
+		state, err := m.resumeState(job, proc)
+		if err == nil {
+			m.follow(job.ID, proc, state)
+			return
+		}
+
+		select {
+		case <-time.After(m.client.phantomPollInterval):
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// resumeState checks on the PHANTOM process of a job being re-attached to. A process with the
+// job's pid is only taken to be the job's if it started at the time recorded at launch; any other
+// process has been given the pid since the job's process exited. Without a recorded start time the
+// process is assumed to be the job's.
+func (m *JobManager) resumeState(job Job, proc *PhantomProc) (phantomStatus, error) {
+
+	script := fmt.Sprintf(`como=%s; trailer=%s
+if grep -F -q "$trailer" "$como" 2>/dev/null; then echo %s; exit 0; fi
+printf 'start=%%s\n' "$(ps -o lstart= -p %d 2>/dev/null)"`,
+		shellQuote(proc.OutFile), shellQuote(phantomTrailer(proc.Pid)), phantomCompleted, proc.Pid)
+
+	out, err := m.client.shellOutput(m.ctx, script)
+	if err != nil {
+		return "", err
+	}
+
+	out = strings.TrimSpace(out)
+	if out == string(phantomCompleted) {
+		return phantomCompleted, nil
+	}
+	if !strings.HasPrefix(out, "start=") {
+		return "", &CommandError{Command: script, Output: out, Err: errors.New("unexpected response")}
+	}
+
+	switch start := strings.TrimSpace(strings.TrimPrefix(out, "start=")); {
+	case start == "":
+		return phantomExited, nil
+	case job.ProcStart != "" && start != job.ProcStart:
+		return phantomExited, nil
+	}
+	return phantomRunning, nil
+}
+
+// procStart returns the start time of a process as reported by ps, or blank if it isn't running
+func (m *JobManager) procStart(pid int) (string, error) {
+	out, err := m.client.shellOutput(m.ctx, fmt.Sprintf("ps -o lstart= -p %d 2>/dev/null; true", pid))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// follow waits for the job's PHANTOM process to finish, unless state shows it already has, and
+// records the outcome
+func (m *JobManager) follow(id string, proc *PhantomProc, state phantomStatus) {
+
+	if state == phantomRunning {
+		var err error
+		if state, err = m.watch(proc); err != nil {
+			// Closed, leave it running
+			return
+		}
+	}
+
+	if err := m.collect(id, proc); err != nil {
+		if m.ctx.Err() != nil {
+			return
+		}
+		m.finish(id, JobFailed, err)
+		return
+	}
+
+	if state == phantomExited {
+		m.finish(id, JobFailed, fmt.Errorf("PHANTOM process %d: %w", proc.Pid, ErrPhantomIncomplete))
+	} else {
+		m.finish(id, JobSucceeded, nil)
+	}
+
+	// The output is safely stored, the COMO file can go
+	_ = m.client.transport.Remove(proc.OutFile)
+}
+
+// watch polls the PHANTOM process until it completes or exits. Errors checking on the process are
+// retried, so it only fails once the JobManager is closed.
+func (m *JobManager) watch(proc *PhantomProc) (phantomStatus, error) {
+	for {
+		state, err := m.client.phantomState(m.ctx, proc)
+		if err == nil && state != phantomRunning {
+			return state, nil
+		}
+
+		select {
+		case <-time.After(m.client.phantomPollInterval):
+		case <-m.ctx.Done():
+			return "", m.ctx.Err()
+		}
+	}
+}
+
+// collect copies the COMO file of a finished PHANTOM process to the store, without its trailer
+func (m *JobManager) collect(id string, proc *PhantomProc) (err error) {
+
+	f, err := m.client.openFile(m.ctx, proc.OutFile)
+	if err != nil {
+		return fmt.Errorf("failed to open UDT output file (%s): %w", proc.OutFile, err)
+	}
+	defer safeClose(f, "error closing UDT output file", &err)
+
+	w, err := m.store.CreateOutput(id)
+	if err != nil {
+		return fmt.Errorf("failed to create job output: %w", err)
+	}
+	defer safeClose(w, "error closing job output", &err)
+
+	r := m.client.decodeReader(truncatereader.NewTruncReader(newContextReader(m.ctx, f), []byte(phantomTrailer(proc.Pid)+"\n")))
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("error collecting job output: %w", err)
+	}
+	return nil
+}
+
+// finish records the final status of a job and wakes anyone waiting for it
+func (m *JobManager) finish(id string, status JobStatus, err error) {
+	m.update(id, func(job *Job) {
+		job.Status = status
+		job.Finished = time.Now()
+		if err != nil {
+			job.Error = err.Error()
+		}
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if done := m.done[id]; done != nil {
+		close(done)
+		delete(m.done, id)
+	}
+}
+
+// update applies fn to a job and saves it
+func (m *JobManager) update(id string, fn func(job *Job)) {
+	m.mu.Lock()
+	job := m.jobs[id]
+	fn(job)
+	saved := *job
+	m.mu.Unlock()
+
+	if err := m.store.Save(&saved); err != nil {
+		m.mu.Lock()
+		if m.storeErr == nil {
+			m.storeErr = fmt.Errorf("failed to save job %s: %w", id, err)
+		}
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,237 @@
+package udt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestJobStore(t *testing.T) (*FileJobStore, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "udt-jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFileJobStore(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return store, func() { os.RemoveAll(dir) }
+}
+
+func jobOutput(t *testing.T, m *JobManager, id string) string {
+	t.Helper()
+
+	r, err := m.Output(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestJobManager(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t, WithMaxPhantoms(1))
+	defer cleanup()
+	store, cleanupStore := newTestJobStore(t)
+	defer cleanupStore()
+
+	m, err := NewJobManager(c, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	var ids []string
+	for _, statement := range []string{"SLEEP 1", "HELLO", "CRASH"} {
+		job, err := m.Submit(statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, job.ID)
+	}
+
+	// Only one PHANTOM process runs at a time
+	if job, _ := m.Job(ids[1]); job.Status != JobQueued {
+		t.Errorf("expected second job to be queued, it is %s", job.Status)
+	}
+
+	expected := []struct {
+		status JobStatus
+		output string
+	}{
+		{JobSucceeded, "sleeping\nslept\n"},
+		{JobSucceeded, "HELLO\n"},
+		{JobFailed, "crashing\n"},
+	}
+	for i, id := range ids {
+		job, err := m.Wait(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != expected[i].status {
+			t.Errorf("job %d: expected %s, received %s (%s)", i, expected[i].status, job.Status, job.Error)
+		}
+		if out := jobOutput(t, m, id); out != expected[i].output {
+			t.Errorf("job %d: unexpected output: %q", i, out)
+		}
+	}
+
+	if job, _ := m.Job(ids[2]); !strings.Contains(job.Error, ErrPhantomIncomplete.Error()) {
+		t.Errorf("unexpected error: %q", job.Error)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertDirEmpty(t, env.UdtAcct+"/_PH_")
+}
+
+func TestJobManagerResume(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t, WithMaxPhantoms(1))
+	defer cleanup()
+	store, cleanupStore := newTestJobStore(t)
+	defer cleanupStore()
+
+	m, err := NewJobManager(c, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	running, err := m.Submit("SLEEP 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, err := m.Submit("HELLO")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if job, _ := m.Job(running.ID); job.Status == JobRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Stop tracking the jobs, as if the program had exited
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := m.Job(running.ID); job.Status != JobRunning || job.ProcStart == "" {
+		t.Fatalf("expected first job to be running with a start time, it is %s (%q)", job.Status, job.ProcStart)
+	}
+
+	m, err = NewJobManager(c, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	for _, id := range []string{running.ID, queued.ID} {
+		job, err := m.Wait(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != JobSucceeded {
+			t.Errorf("expected job to succeed, it %s (%s)", job.Status, job.Error)
+		}
+	}
+	if out := jobOutput(t, m, running.ID); out != "sleeping\nslept\n" {
+		t.Errorf("unexpected output: %q", out)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertDirEmpty(t, env.UdtAcct+"/_PH_")
+}
+
+func TestJobManagerResumeReusedPid(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+	store, cleanupStore := newTestJobStore(t)
+	defer cleanupStore()
+
+	// An unrelated process now has the pid of a job's PHANTOM process, which started earlier
+	const jobProcStart = "Thu Jan  1 00:00:00 1970"
+	other := exec.Command("sleep", "30")
+	if err := other.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		other.Process.Kill()
+		other.Wait()
+	}()
+	pid := other.Process.Pid
+
+	jobs := []struct {
+		job  *Job
+		como string
+	}{
+		// The process exited without completing its COMO file
+		{&Job{ID: "crashed", Command: "SLEEP 30", Pid: pid, ProcStart: jobProcStart}, "sleeping\n"},
+		// The process completed before the pid was reused
+		{&Job{ID: "completed", Command: "HELLO", Pid: pid, ProcStart: jobProcStart}, fmt.Sprintf("HELLO\n%s\n", phantomTrailer(pid))},
+		// Without a start time to go by, the process might still be the job's
+		{&Job{ID: "unknown", Command: "SLEEP 30", Pid: pid}, "sleeping\n"},
+	}
+	for i, j := range jobs {
+		j.job.Status = JobRunning
+		j.job.OutFile = fmt.Sprintf("%s/_PH_/test%d_%d", env.UdtAcct, pid, i)
+		j.job.Submitted = time.Now()
+		if err := ioutil.WriteFile(j.job.OutFile, []byte(j.como), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Save(j.job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := NewJobManager(c, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	expected := map[string]JobStatus{"crashed": JobFailed, "completed": JobSucceeded}
+	for id, status := range expected {
+		job, err := m.Wait(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != status {
+			t.Errorf("%s: expected %s, received %s (%s)", id, status, job.Status, job.Error)
+		}
+	}
+	if out := jobOutput(t, m, "completed"); out != "HELLO\n" {
+		t.Errorf("unexpected output: %q", out)
+	}
+
+	// The job that can't be told apart from the unrelated process is left running, COMO file and all
+	time.Sleep(50 * time.Millisecond)
+	if job, _ := m.Job("unknown"); job.Status != JobRunning {
+		t.Errorf("expected the job to be running, it is %s (%s)", job.Status, job.Error)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	unknown, _ := m.Job("unknown")
+	if err := os.Remove(unknown.OutFile); err != nil {
+		t.Error(err)
+	}
+	assertDirEmpty(t, env.UdtAcct+"/_PH_")
+}
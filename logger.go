@@ -0,0 +1,19 @@
+package udt
+
+import "time"
+
+// Logger receives diagnostic messages from a Client. Implementations must be safe for concurrent use.
+type Logger interface {
+	// LogCommand is called once each shell command run on the database host has finished, with the
+	// time it took and the error it finished with, if any
+	LogCommand(cmd string, duration time.Duration, err error)
+
+	// LogAgent is called with each debug message or unrecognized line printed by the agent program
+	// of a QueryBatched, along with the UUID of the query
+	LogAgent(queryID string, line string)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) LogCommand(string, time.Duration, error) {}
+func (nopLogger) LogAgent(string, string)                 {}
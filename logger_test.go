@@ -0,0 +1,133 @@
+package udt
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingLogger keeps everything it is given
+type recordingLogger struct {
+	mu       sync.Mutex
+	commands []loggedCommand
+	agent    []loggedAgentLine
+}
+
+type loggedCommand struct {
+	cmd      string
+	duration time.Duration
+	err      error
+}
+
+type loggedAgentLine struct {
+	queryID string
+	line    string
+}
+
+func (l *recordingLogger) LogCommand(cmd string, duration time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.commands = append(l.commands, loggedCommand{cmd, duration, err})
+}
+
+func (l *recordingLogger) LogAgent(queryID string, line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.agent = append(l.agent, loggedAgentLine{queryID, line})
+}
+
+// command returns the logged command containing s
+func (l *recordingLogger) command(t *testing.T, s string) loggedCommand {
+	t.Helper()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range l.commands {
+		if strings.Contains(c.cmd, s) {
+			return c
+		}
+	}
+	t.Fatalf("no command containing %q was logged", s)
+	return loggedCommand{}
+}
+
+func TestLoggerCommands(t *testing.T) {
+
+	logger := &recordingLogger{}
+	c, _, cleanup := newTestClient(t, WithLogger(logger))
+	defer cleanup()
+
+	proc, err := c.Execute("HELLO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proc.Output(); err != nil {
+		t.Fatal(err)
+	}
+
+	proc, err = c.Execute("EXIT 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proc.Output(); err == nil {
+		t.Fatal("expected an error from a command exiting with status 3")
+	}
+
+	logged := logger.command(t, "HELLO")
+	if logged.err != nil {
+		t.Errorf("expected success to be logged, received %v", logged.err)
+	}
+	if logged.duration <= 0 {
+		t.Errorf("expected a duration, received %s", logged.duration)
+	}
+	if !strings.Contains(logged.cmd, "/udt") {
+		t.Errorf("expected the full command line, received %q", logged.cmd)
+	}
+
+	logged = logger.command(t, "EXIT")
+	if status, ok := exitStatus(logged.err); !ok || status != 3 {
+		t.Errorf("expected exit status 3 to be logged, received %v", logged.err)
+	}
+}
+
+func TestLoggerAgent(t *testing.T) {
+
+	for _, debug := range []int{0, 1} {
+		logger := &recordingLogger{}
+		c, _, cleanup := newTestClient(t, WithLogger(logger))
+
+		q, err := NewQueryBatched(c, &QueryConfig{File: "ORDERS", Fields: []string{"ID"}, BatchSize: 2, DebugLevel: debug})
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		for {
+			if _, err := q.ReadRecord(); err != nil {
+				break
+			}
+		}
+		q.Close()
+		cleanup()
+
+		var lines []string
+		for _, l := range logger.agent {
+			lines = append(lines, l.line)
+			if l.queryID == "" || l.queryID != logger.agent[0].queryID {
+				t.Errorf("debug %d: unexpected query ID %q", debug, l.queryID)
+			}
+		}
+
+		var expected []string
+		if debug > 0 {
+			expected = []string{"|DEBUG|12345|selected 5 records", "stray agent output"}
+		}
+		if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("debug %d: expected %q, received %q", debug, expected, lines)
+		}
+
+		// The query ID is that of the agent program that was run
+		if len(logger.agent) > 0 {
+			logger.command(t, "RUN BP "+agentProgPrefix+logger.agent[0].queryID)
+		}
+	}
+}
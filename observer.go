@@ -0,0 +1,197 @@
+package udt
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Op identifies the kind of operation described by an Event
+type Op int
+
+const (
+	// OpCommand is a shell command run in its own session on the database host
+	OpCommand Op = iota
+	// OpTransfer is a file read from or written to the database host
+	OpTransfer
+	// OpPhantomLaunch is the launch of a PHANTOM process
+	OpPhantomLaunch
+	// OpPhantomWait is the wait for a PHANTOM process to complete
+	OpPhantomWait
+	// OpCompile is the upload and compilation of a BASIC program
+	OpCompile
+	// OpBatch is the retrieval and reading of one batch of QueryBatched results
+	OpBatch
+	// OpStatement is a statement run in a Session
+	OpStatement
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpCommand:
+		return "command"
+	case OpTransfer:
+		return "transfer"
+	case OpPhantomLaunch:
+		return "phantom-launch"
+	case OpPhantomWait:
+		return "phantom-wait"
+	case OpCompile:
+		return "compile"
+	case OpBatch:
+		return "batch"
+	case OpStatement:
+		return "statement"
+	}
+	return "unknown"
+}
+
+// Event describes an operation performed by a Client
+type Event struct {
+	Op Op
+
+	// Detail identifies the operation: a command line, file path, PHANTOM command or pid, BASIC
+	// program, query UUID and batch number, or Session statement
+	Detail string
+
+	Start time.Time
+
+	// The remaining fields are filled in when the operation ends. Bytes is set for transfers and
+	// batches, Records for batches.
+	Duration time.Duration
+	Bytes    int64
+	Records  int
+	Err      error
+}
+
+// Observer is notified at the start and end of each operation performed by a Client, which allows
+// tracing and metrics to be collected. Implementations must be safe for concurrent use.
+type Observer interface {
+	// OpStart is called when an operation starts. The returned context is passed to OpEnd and to
+	// the OpStart of any operations nested within this one, so it can carry e.g. a tracing span.
+	OpStart(ctx context.Context, ev *Event) context.Context
+
+	// OpEnd is called when an operation ends with the completed Event
+	OpEnd(ctx context.Context, ev *Event)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) OpStart(ctx context.Context, _ *Event) context.Context { return ctx }
+func (nopObserver) OpEnd(context.Context, *Event)                         {}
+
+// observation tracks an operation between its start and end
+type observation struct {
+	observer Observer
+	ctx      context.Context
+	ev       Event
+	bytes    int64
+	endOnce  sync.Once
+}
+
+// startOp notifies the client's Observer that an operation is starting. The returned context should
+// be used for any nested operations.
+func (c *Client) startOp(ctx context.Context, op Op, detail string) (context.Context, *observation) {
+	o := &observation{
+		observer: c.observer,
+		ev: Event{
+			Op:     op,
+			Detail: detail,
+			Start:  time.Now(),
+		},
+	}
+	o.ctx = c.observer.OpStart(ctx, &o.ev)
+	return o.ctx, o
+}
+
+// addBytes records bytes transferred during the operation
+func (o *observation) addBytes(n int) {
+	atomic.AddInt64(&o.bytes, int64(n))
+}
+
+// end notifies the Observer that the operation has ended. Only the first call has any effect.
+func (o *observation) end(err error) {
+	o.endOnce.Do(func() {
+		o.ev.Duration = time.Since(o.ev.Start)
+		o.ev.Bytes = atomic.LoadInt64(&o.bytes)
+		o.ev.Err = err
+		o.observer.OpEnd(o.ctx, &o.ev)
+	})
+}
+
+// observedReader counts bytes read through it
+type observedReader struct {
+	r   io.Reader
+	obs *observation
+}
+
+func (r *observedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.obs.addBytes(n)
+	return n, err
+}
+
+// trackedCmd reports a Cmd to the client's Logger and Observer once it has been waited on or closed,
+// and frees its session slot
+type trackedCmd struct {
+	Cmd
+	client   *Client
+	ctx      context.Context
+	shellCmd string
+
+	start       time.Time
+	obs         *observation
+	endOnce     sync.Once
+	releaseOnce sync.Once
+}
+
+// RequestPTY passes the request on to the wrapped Cmd if it is a PTYCmd
+func (c *trackedCmd) RequestPTY(term string, height, width int) error {
+	ptyCmd, ok := c.Cmd.(PTYCmd)
+	if !ok {
+		return errPTYUnsupported
+	}
+	return ptyCmd.RequestPTY(term, height, width)
+}
+
+func (c *trackedCmd) Start() error {
+	c.start = time.Now()
+	_, c.obs = c.client.startOp(c.ctx, OpCommand, c.shellCmd)
+	err := c.Cmd.Start()
+	if err != nil {
+		c.end(err)
+	}
+	return err
+}
+
+func (c *trackedCmd) Wait() error {
+	err := c.Cmd.Wait()
+	c.end(err)
+	c.releaseSession()
+	return err
+}
+
+func (c *trackedCmd) Close() error {
+	err := c.Cmd.Close()
+	c.end(err)
+	c.releaseSession()
+	return err
+}
+
+// releaseSession frees the command's session slot once it has exited or been closed
+func (c *trackedCmd) releaseSession() {
+	c.releaseOnce.Do(c.client.sessions.release)
+}
+
+func (c *trackedCmd) end(err error) {
+	if c.obs == nil {
+		// Never started
+		return
+	}
+	c.endOnce.Do(func() {
+		c.client.logger.LogCommand(c.shellCmd, time.Since(c.start), err)
+		c.obs.end(err)
+	})
+}
@@ -0,0 +1,162 @@
+package udt
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type parentOpKey struct{}
+
+// recordingObserver keeps the events it is given, noting the operation each one is nested within
+type recordingObserver struct {
+	mu      sync.Mutex
+	started []Event
+	ended   []Event
+	parents map[*Event]Op
+}
+
+func (o *recordingObserver) OpStart(ctx context.Context, ev *Event) context.Context {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.started = append(o.started, *ev)
+	if parent, ok := ctx.Value(parentOpKey{}).(Op); ok {
+		o.parents[ev] = parent
+	}
+	return context.WithValue(ctx, parentOpKey{}, ev.Op)
+}
+
+func (o *recordingObserver) OpEnd(ctx context.Context, ev *Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.ended = append(o.ended, *ev)
+}
+
+// ends returns the ended events for op
+func (o *recordingObserver) ends(op Op) []Event {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var events []Event
+	for _, ev := range o.ended {
+		if ev.Op == op {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+// nested reports whether an operation of kind op was started within an operation of kind parent
+func (o *recordingObserver) nested(op Op, parent Op) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for ev, p := range o.parents {
+		if ev.Op == op && p == parent {
+			return true
+		}
+	}
+	return false
+}
+
+func TestObserver(t *testing.T) {
+
+	observer := &recordingObserver{parents: make(map[*Event]Op)}
+	c, _, cleanup := newTestClient(t, WithObserver(observer))
+	defer cleanup()
+
+	if err := c.CompileBasicProgram("BP", "OBSERVED", "RETURN\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.ExecutePhantom("HELLO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	q, err := NewQueryBatched(c, &QueryConfig{File: "ORDERS", Fields: []string{"ID"}, BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := 0
+	for {
+		if _, err := q.ReadRecord(); err != nil {
+			break
+		}
+		records++
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every operation that started has ended, successfully and with a duration
+	observer.mu.Lock()
+	if len(observer.started) != len(observer.ended) {
+		t.Errorf("%d operations started but %d ended", len(observer.started), len(observer.ended))
+	}
+	for _, ev := range observer.ended {
+		if ev.Err != nil {
+			t.Errorf("%s %s: %v", ev.Op, ev.Detail, ev.Err)
+		}
+		if ev.Duration <= 0 || ev.Start.IsZero() {
+			t.Errorf("%s %s: unexpected start %s and duration %s", ev.Op, ev.Detail, ev.Start, ev.Duration)
+		}
+	}
+	observer.mu.Unlock()
+
+	if compiles := observer.ends(OpCompile); len(compiles) != 2 || compiles[0].Detail != "BP OBSERVED" {
+		t.Errorf("expected the program and the agent to be compiled, received %+v", compiles)
+	}
+	if launches := observer.ends(OpPhantomLaunch); len(launches) < 3 || launches[0].Detail != "BASIC BP OBSERVED" {
+		t.Errorf("unexpected PHANTOM launches: %+v", launches)
+	}
+	if waits := observer.ends(OpPhantomWait); len(waits) != len(observer.ends(OpPhantomLaunch)) {
+		t.Errorf("expected a wait for each PHANTOM launch, received %+v", waits)
+	}
+
+	// The output of HELLO is the first transfer read from a COMO file
+	var comoBytes int64 = -1
+	for _, ev := range observer.ends(OpTransfer) {
+		if strings.Contains(ev.Detail, "/_PH_/") {
+			comoBytes = ev.Bytes
+			break
+		}
+	}
+	if comoBytes <= int64(len("HELLO\n")) {
+		t.Errorf("expected the COMO file transfer to count its bytes, received %d", comoBytes)
+	}
+
+	batches := observer.ends(OpBatch)
+	if len(batches) != 3 {
+		t.Fatalf("expected 3 batches, received %+v", batches)
+	}
+	batchRecords := 0
+	for _, ev := range batches {
+		batchRecords += ev.Records
+		if ev.Bytes <= 0 {
+			t.Errorf("batch %s: expected a byte count, received %d", ev.Detail, ev.Bytes)
+		}
+	}
+	if records != 5 || batchRecords != records {
+		t.Errorf("read %d records, batches counted %d", records, batchRecords)
+	}
+
+	// Nested operations see the context returned by their parent's OpStart
+	if !observer.nested(OpCommand, OpPhantomLaunch) {
+		t.Error("expected PHANTOM commands to be nested within their launch")
+	}
+	if !observer.nested(OpPhantomLaunch, OpCompile) {
+		t.Error("expected the compiler's PHANTOM to be nested within the compile")
+	}
+	if !observer.nested(OpTransfer, OpBatch) {
+		t.Error("expected result files to be transferred within their batch")
+	}
+}
@@ -0,0 +1,231 @@
+package udt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listUserTimeLayout is the format of the TIME and DATE columns of LISTUSER
+const listUserTimeLayout = "15:04:05 Jan 2 2006"
+
+// PhantomInfo describes a PHANTOM process running on the database host
+type PhantomInfo struct {
+	Pid  int
+	User string
+
+	// Start is when the process logged in, in the host's local time as reported by LISTUSER. It is
+	// zero if the time couldn't be parsed.
+	Start time.Time
+
+	// Command is the process's command line as reported by ps
+	Command string
+
+	// OutFile is the process's COMO file, or blank if it couldn't be found
+	OutFile string
+}
+
+// Proc returns a PhantomProc for the process that can be passed to e.g. StopPhantom
+func (p *PhantomInfo) Proc() *PhantomProc {
+	return &PhantomProc{Pid: p.Pid, OutFile: p.OutFile}
+}
+
+// ListPhantoms returns the PHANTOM processes running on the database, including those started by
+// other clients and users. The processes are found with LISTUSER, their command lines with ps, and
+// their COMO files by looking in the account's _PH_ directory for a file named after the pid.
+func (c *Client) ListPhantoms() ([]*PhantomInfo, error) {
+	return c.ListPhantomsContext(context.Background())
+}
+
+// ListPhantomsContext is like ListPhantoms but gives up if ctx is done
+func (c *Client) ListPhantomsContext(ctx context.Context) ([]*PhantomInfo, error) {
+
+	out, err := c.shellOutput(ctx, c.udtShellCmd("LISTUSER"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	phantoms := parseListUser(out)
+	if len(phantoms) == 0 {
+		return nil, nil
+	}
+
+	pids := make([]string, len(phantoms))
+	for i, p := range phantoms {
+		pids[i] = strconv.Itoa(p.Pid)
+	}
+
+	// Print the COMO file and command line of each process, tab separated. COMO files are named
+	// <user><pid>_<time>, so the pid mustn't follow a digit, or pid 123 would match user5123_1.
+	script := fmt.Sprintf(`cd %s || exit 1
+for pid in %s; do
+	como=$(ls -d _PH_/"$pid"_* _PH_/*[!0-9]"$pid"_* 2>/dev/null | head -n 1)
+	args=$(ps -o args= -p "$pid" 2>/dev/null)
+	printf '%%s\t%%s\t%%s\n' "$pid" "$como" "$args"
+done`, shellQuote(c.env.UdtAcct), strings.Join(pids, " "))
+
+	out, err = c.shellOutput(ctx, script)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect PHANTOM processes: %w", err)
+	}
+
+	byPid := make(map[int]*PhantomInfo, len(phantoms))
+	for _, p := range phantoms {
+		byPid[p.Pid] = p
+	}
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		fields := strings.SplitN(s.Text(), "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil || byPid[pid] == nil {
+			continue
+		}
+		if fields[1] != "" {
+			byPid[pid].OutFile = c.env.UdtAcct + "/" + fields[1]
+		}
+		byPid[pid].Command = strings.TrimSpace(fields[2])
+	}
+
+	// COMO files of our own processes are already known
+	c.phantomsMu.Lock()
+	for proc := range c.phantomsHeld {
+		if p := byPid[proc.Pid]; p != nil {
+			p.OutFile = proc.OutFile
+		}
+	}
+	c.phantomsMu.Unlock()
+
+	return phantoms, nil
+}
+
+// parseListUser returns the PHANTOM processes in the output of LISTUSER, which lists each user on a
+// line of the form:
+//
+//	UDTNO USRNBR UID USRNAME USRTYPE TTY IP-ADDRESS TIME DATE
+//	    2  12399 1001 sam    phantom pts/1 Console  10:16:01 Oct 16 2026
+func parseListUser(out string) []*PhantomInfo {
+	var phantoms []*PhantomInfo
+
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 || !strings.EqualFold(fields[4], "phantom") {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[0]); err != nil {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+
+		p := &PhantomInfo{Pid: pid, User: fields[3]}
+		if n := len(fields); n >= 9 {
+			start, err := time.ParseInLocation(listUserTimeLayout, strings.Join(fields[n-4:], " "), time.Local)
+			if err == nil {
+				p.Start = start
+			}
+		}
+		phantoms = append(phantoms, p)
+	}
+	return phantoms
+}
+
+// KillPhantom kills a PHANTOM process immediately and removes its COMO file. See StopPhantom for
+// giving the process a chance to exit cleanly.
+func (c *Client) KillPhantom(proc *PhantomProc) error {
+	return c.StopPhantomContext(context.Background(), proc, 0)
+}
+
+// KillPhantomContext is like KillPhantom but gives up if ctx is done
+func (c *Client) KillPhantomContext(ctx context.Context, proc *PhantomProc) error {
+	return c.StopPhantomContext(ctx, proc, 0)
+}
+
+// StopPhantom asks a PHANTOM process to exit with SIGTERM, killing it with SIGKILL if it is still
+// running after grace, then removes its COMO file once it has exited. A process that has already
+// exited isn't an error, while one that can't be signalled, such as another user's, is. If the
+// process was started by this client, its phantoms slot is freed.
+func (c *Client) StopPhantom(proc *PhantomProc, grace time.Duration) error {
+	return c.StopPhantomContext(context.Background(), proc, grace)
+}
+
+// StopPhantomContext is like StopPhantom but gives up waiting for the process to exit if ctx is
+// done, leaving it running.
+func (c *Client) StopPhantomContext(ctx context.Context, proc *PhantomProc, grace time.Duration) error {
+
+	signal := "KILL"
+	if grace > 0 {
+		signal = "TERM"
+	}
+	if err := c.signalPhantom(ctx, proc, signal); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(grace)
+	for {
+		running, err := c.phantomRunning(ctx, proc)
+		if err != nil {
+			return err
+		}
+		if !running {
+			break
+		}
+		if signal != "KILL" && time.Now().After(deadline) {
+			signal = "KILL"
+			if err := c.signalPhantom(ctx, proc, signal); err != nil {
+				return err
+			}
+			continue
+		}
+
+		select {
+		case <-time.After(c.phantomPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	c.releasePhantom(proc)
+
+	if proc.OutFile != "" {
+		if err := c.transport.Remove(proc.OutFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error removing COMO file (%s): %w", proc.OutFile, err)
+		}
+	}
+	return nil
+}
+
+// signalPhantom sends a signal to a PHANTOM process, ignoring a process that has already exited.
+// kill also fails for a process we aren't permitted to signal, so the process is only taken to have
+// exited if ps can't find it either.
+func (c *Client) signalPhantom(ctx context.Context, proc *PhantomProc, signal string) error {
+	script := fmt.Sprintf(`pid=%d
+msg=$(kill -%s "$pid" 2>&1) && exit 0
+ps -p "$pid" >/dev/null 2>&1 || exit 0
+echo "$msg"
+exit 1`, proc.Pid, signal)
+	if _, err := c.shellOutput(ctx, script); err != nil {
+		return fmt.Errorf("failed to signal PHANTOM process %d: %w", proc.Pid, err)
+	}
+	return nil
+}
+
+// phantomRunning reports whether a PHANTOM process is still running. A zombie has exited.
+func (c *Client) phantomRunning(ctx context.Context, proc *PhantomProc) (bool, error) {
+	out, err := c.shellOutput(ctx, fmt.Sprintf("ps -o stat= -p %d 2>/dev/null || true", proc.Pid))
+	if err != nil {
+		return false, fmt.Errorf("failed to check on PHANTOM process %d: %w", proc.Pid, err)
+	}
+	out = strings.TrimSpace(out)
+	return out != "" && !strings.HasPrefix(out, "Z"), nil
+}
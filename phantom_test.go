@@ -0,0 +1,314 @@
+package udt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitPhantom(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	proc, err := c.ExecutePhantomAsync("SLEEP 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.WaitPhantom(proc); err != nil {
+		t.Fatal(err)
+	}
+
+	// The output is complete once WaitPhantom returns
+	r, err := c.RetrieveOutput(proc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "sleeping\nslept\n" {
+		t.Errorf("unexpected output: %q", out)
+	}
+}
+
+func TestWaitPhantomIncomplete(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	proc, err := c.ExecutePhantomAsync("CRASH")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.WaitPhantom(proc); !errors.Is(err, ErrPhantomIncomplete) {
+		t.Fatalf("expected %v, received %v", ErrPhantomIncomplete, err)
+	}
+
+	// The partial COMO file is left for inspection
+	if _, err := os.Stat(proc.OutFile); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(proc.OutFile)
+}
+
+func TestWaitPhantomTimeout(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t, WithPhantomPolling(10*time.Millisecond, 200*time.Millisecond))
+	defer cleanup()
+
+	proc, err := c.ExecutePhantomAsync("SLEEP 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := c.WaitPhantom(proc); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, received %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s to time out", elapsed)
+	}
+
+	// The process has been killed and its COMO file removed
+	if processRunning(proc.Pid) {
+		t.Errorf("PHANTOM process %d is still running", proc.Pid)
+	}
+	assertDirEmpty(t, env.UdtAcct+"/_PH_")
+}
+
+// processRunning reports whether the process is alive. Zombies don't count, as nothing may be
+// reaping orphans in the test environment.
+func processRunning(pid int) bool {
+	out, err := exec.Command("ps", "-o", "stat=", "-p", strconv.Itoa(pid)).Output()
+	return err == nil && len(out) > 0 && out[0] != 'Z'
+}
+
+func TestListPhantoms(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	proc, err := c.ExecutePhantomAsync("SLEEP 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.KillPhantom(proc)
+
+	// Wait for the COMO file so a client that didn't start the process can find it
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(proc.OutFile); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	other, err := NewClient(NewLocalTransport(), env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	for _, c := range []*Client{c, other} {
+		phantoms, err := c.ListPhantoms()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var found *PhantomInfo
+		for _, p := range phantoms {
+			if p.Pid == proc.Pid {
+				found = p
+			}
+		}
+		if found == nil {
+			t.Fatalf("PHANTOM process %d not listed: %+v", proc.Pid, phantoms)
+		}
+
+		if found.User != "test" {
+			t.Errorf("unexpected user: %q", found.User)
+		}
+		if found.Start.IsZero() {
+			t.Error("start time not parsed")
+		}
+		if !strings.Contains(found.Command, "SLEEP 10") {
+			t.Errorf("unexpected command: %q", found.Command)
+		}
+		if found.OutFile != proc.OutFile {
+			t.Errorf("expected COMO file %q, received %q", proc.OutFile, found.OutFile)
+		}
+	}
+}
+
+func TestListPhantomsComoFile(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	proc, err := c.ExecutePhantomAsync("SLEEP 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.KillPhantom(proc)
+
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(proc.OutFile); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The COMO file of a process whose pid ends with this one's, listed ahead of it
+	decoy := env.UdtAcct + "/_PH_/aaa9" + strconv.Itoa(proc.Pid) + "_1"
+	if err := ioutil.WriteFile(decoy, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(decoy)
+
+	other, err := NewClient(NewLocalTransport(), env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	phantoms, err := other.ListPhantoms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found *PhantomInfo
+	for _, p := range phantoms {
+		if p.Pid == proc.Pid {
+			found = p
+		}
+	}
+	if found == nil {
+		t.Fatalf("PHANTOM process %d not listed: %+v", proc.Pid, phantoms)
+	}
+	if found.OutFile != proc.OutFile {
+		t.Errorf("expected COMO file %q, received %q", proc.OutFile, found.OutFile)
+	}
+
+	// Stopping the process leaves the other COMO file alone
+	if err := other.KillPhantom(found.Proc()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(decoy); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseListUser(t *testing.T) {
+
+	out := `
+   Max Number of Users      UDT     SQL    iPHANTOM   SQL PHANTOM   Total
+   ===================     =====   =====   ========   ===========   =====
+            100               1       0        1           0           2
+
+   UDTNO USRNBR     UID USRNAME  USRTYPE      TTY       IP-ADDRESS         TIME DATE
+   ===== ======  ====== ======== ======= ======== ================ ============
+       1  12345    1001 sam      udt     pts/0    192.168.1.10     10:15:32 Oct 16 2026
+       2  12399    1001 sam      phantom phantom  Console          10:16:01 Oct 16 2026
+`
+
+	phantoms := parseListUser(out)
+	if len(phantoms) != 1 {
+		t.Fatalf("expected 1 PHANTOM process, received %d", len(phantoms))
+	}
+
+	p := phantoms[0]
+	if p.Pid != 12399 || p.User != "sam" {
+		t.Errorf("unexpected process: %+v", p)
+	}
+	if expected := time.Date(2026, time.October, 16, 10, 16, 1, 0, time.Local); !p.Start.Equal(expected) {
+		t.Errorf("expected start %s, received %s", expected, p.Start)
+	}
+}
+
+func TestStopPhantom(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	proc, err := c.ExecutePhantomAsync("SLEEP 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.StopPhantom(proc, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if processRunning(proc.Pid) {
+		t.Errorf("PHANTOM process %d is still running", proc.Pid)
+	}
+	assertDirEmpty(t, env.UdtAcct+"/_PH_")
+
+	// Stopping it again is harmless
+	if err := c.KillPhantom(proc); err != nil {
+		t.Error(err)
+	}
+}
+
+// setprivTransport runs commands as the nobody user, so they aren't permitted to signal processes
+// started by the test
+type setprivTransport struct {
+	Transport
+}
+
+func (t setprivTransport) Command(shellCmd string) (Cmd, error) {
+	return t.Transport.Command("exec setpriv --reuid=65534 --regid=65534 --clear-groups /bin/sh -c " + shellQuote(shellCmd))
+}
+
+func TestStopPhantomNotPermitted(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	// A process belonging to another user: one of ours when commands are run as nobody, otherwise
+	// init, which an unprivileged user can't signal
+	pid := 1
+	if os.Geteuid() == 0 {
+		if _, err := exec.LookPath("setpriv"); err != nil {
+			t.Skip("setpriv is needed to run commands as another user")
+		}
+		other := exec.Command("sleep", "30")
+		if err := other.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			other.Process.Kill()
+			other.Wait()
+		}()
+		c.transport, pid = setprivTransport{c.transport}, other.Process.Pid
+	}
+
+	proc := &PhantomProc{Pid: pid, OutFile: fmt.Sprintf("%s/_PH_/other%d_1", env.UdtAcct, pid)}
+	if err := ioutil.WriteFile(proc.OutFile, []byte("running\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, grace := range []time.Duration{0, time.Second} {
+		err := c.StopPhantom(proc, grace)
+		var cmdErr *CommandError
+		if !errors.As(err, &cmdErr) {
+			t.Errorf("grace %s: expected a *CommandError, received %v", grace, err)
+		}
+	}
+	if !processRunning(pid) {
+		t.Errorf("process %d is no longer running", pid)
+	}
+	if _, err := os.Stat(proc.OutFile); err != nil {
+		t.Errorf("expected the COMO file to be left alone: %v", err)
+	}
+}
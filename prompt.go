@@ -0,0 +1,145 @@
+package udt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+	"time"
+)
+
+// defaultPromptSettle is how long output must pause before its last line is treated as a prompt
+const defaultPromptSettle = 100 * time.Millisecond
+
+// PromptRule answers prompts matching Pattern with Response
+type PromptRule struct {
+	// Pattern is matched against the unterminated last line of output
+	Pattern *regexp.Regexp
+
+	// Response is sent followed by a newline, an empty Response just presses RETURN
+	Response string
+}
+
+// PromptResponder answers the prompts printed by a process, see UdtProc.Respond
+type PromptResponder struct {
+	// Rules are tried in order, the first match answers the prompt
+	Rules []PromptRule
+
+	// Timeout is how long the process may wait at a prompt that no rule matches before it is killed
+	// and an *UnexpectedPromptError is returned. Zero waits indefinitely.
+	Timeout time.Duration
+
+	// Settle is how long output must pause before its last, unterminated, line is treated as a
+	// prompt. Defaults to 100ms.
+	Settle time.Duration
+}
+
+func (r *PromptResponder) match(prompt string) *PromptRule {
+	for i := range r.Rules {
+		if r.Rules[i].Pattern.MatchString(prompt) {
+			return &r.Rules[i]
+		}
+	}
+	return nil
+}
+
+// Respond answers the process's prompts according to responder and returns a reader for its
+// output, prompts included. Stdout must not be read directly once Respond has been called. The
+// process must have been started by ExecuteInteractive.
+//
+// A prompt is an unterminated line of output after which the process falls silent. If no rule
+// matches a prompt within responder.Timeout the process is killed and reads from the returned
+// reader fail with an *UnexpectedPromptError.
+func (p *UdtProc) Respond(responder *PromptResponder) (io.Reader, error) {
+	if p.Stdin == nil {
+		return nil, errors.New("udt process was not started by ExecuteInteractive")
+	}
+
+	r := *responder
+	if r.Settle <= 0 {
+		r.Settle = defaultPromptSettle
+	}
+
+	pr, pw := io.Pipe()
+	go p.respond(&r, pw)
+	return pr, nil
+}
+
+func (p *UdtProc) respond(r *PromptResponder, out *io.PipeWriter) {
+
+	// Read the output in the background so that a silent process can be noticed
+	chunks := make(chan readResult)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := p.Stdout.Read(buf)
+			select {
+			case chunks <- readResult{append([]byte(nil), buf[:n]...), err}:
+			case <-stop:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// pending holds the unterminated last line of output that hasn't been answered
+	var pending []byte
+	var lastOutput time.Time
+	var wake <-chan time.Time
+
+	for {
+		select {
+		case res := <-chunks:
+			if len(res.buf) > 0 {
+				if _, err := out.Write(res.buf); err != nil {
+					// The reader has been closed
+					return
+				}
+				pending = append(pending, res.buf...)
+				if i := bytes.LastIndexByte(pending, '\n'); i >= 0 {
+					pending = pending[i+1:]
+				}
+				lastOutput = time.Now()
+			}
+			if res.err != nil {
+				if res.err == io.EOF {
+					res.err = nil
+				}
+				out.CloseWithError(res.err)
+				return
+			}
+
+			wake = nil
+			if len(pending) > 0 {
+				wake = time.After(r.Settle)
+			}
+
+		case <-wake:
+			wake = nil
+			prompt := string(pending)
+
+			if rule := r.match(prompt); rule != nil {
+				pending = nil
+				if _, err := io.WriteString(p.Stdin, rule.Response+"\n"); err != nil {
+					out.CloseWithError(err)
+					return
+				}
+				continue
+			}
+
+			if r.Timeout > 0 {
+				remaining := r.Timeout - time.Since(lastOutput)
+				if remaining <= 0 {
+					_ = p.cmd.Kill()
+					out.CloseWithError(&UnexpectedPromptError{Prompt: prompt})
+					return
+				}
+				wake = time.After(remaining)
+			}
+		}
+	}
+}
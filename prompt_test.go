@@ -0,0 +1,113 @@
+package udt
+
+import (
+	"errors"
+	"io/ioutil"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestRespond(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	responder := &PromptResponder{
+		Rules: []PromptRule{
+			{Pattern: regexp.MustCompile(`\(Y/N\) $`), Response: "Y"},
+			{Pattern: regexp.MustCompile(`^Press RETURN`)},
+		},
+		Timeout: time.Second,
+	}
+
+	tests := []struct {
+		statement string
+		expected  string
+	}{
+		{"CLEAR.FILE ORDERS", "Do you want to clear ORDERS? (Y/N) \nORDERS cleared.\n"},
+		{"PAGED", "page 1\nPress RETURN to continue...page 2\nPress RETURN to continue...page 3\n"},
+	}
+
+	for _, test := range tests {
+		proc, err := c.ExecuteInteractive(test.statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := proc.Respond(responder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: %s", test.statement, err)
+		}
+		if string(out) != test.expected {
+			t.Errorf("%s: expected %q, received %q", test.statement, test.expected, out)
+		}
+		if err := proc.Wait(); err != nil {
+			t.Errorf("%s: %s", test.statement, err)
+		}
+		proc.Close()
+	}
+}
+
+func TestRespondUnexpectedPrompt(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	proc, err := c.ExecuteInteractive("CLEAR.FILE ORDERS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	r, err := proc.Respond(&PromptResponder{
+		Rules:   []PromptRule{{Pattern: regexp.MustCompile(`^Press RETURN`)}},
+		Timeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = ioutil.ReadAll(r)
+
+	var promptErr *UnexpectedPromptError
+	if !errors.As(err, &promptErr) {
+		t.Fatalf("expected an *UnexpectedPromptError, received %v", err)
+	}
+	if promptErr.Prompt != "Do you want to clear ORDERS? (Y/N) " {
+		t.Errorf("unexpected prompt reported: %q", promptErr.Prompt)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %s to give up on the prompt", elapsed)
+	}
+}
+
+func TestRespondNotInteractive(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	proc, err := c.Execute("CLEAR.FILE ORDERS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	if _, err := proc.Respond(&PromptResponder{}); err == nil {
+		t.Fatal("expected an error responding to a process without stdin")
+	}
+
+	// Without stdin the prompt reads end-of-file rather than hanging
+	out, err := ioutil.ReadAll(proc.Stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "Do you want to clear ORDERS? (Y/N) \nORDERS not cleared.\n" {
+		t.Errorf("unexpected output: %q", out)
+	}
+}
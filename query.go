@@ -1,5 +1,7 @@
 package udt
 
+import "context"
+
 // NewQuery creates a new Query object from a query string
 func NewQuery(query string) *Query {
 	return &Query{
@@ -12,12 +14,21 @@ type Query struct {
 	query string
 }
 
-// Run runs the query on the provided Client returning a Results object
+// Run runs the query on the provided Client returning a Results object. A *UniDataError is returned
+// if UniData rejects the query, see WithErrorDetection.
 func (q *Query) Run(client *Client) (*Results, error) {
-	r, err := client.ExecutePhantom(q.query)
+	return q.RunContext(context.Background(), client)
+}
+
+// RunContext is like Run but the query's PHANTOM process is killed if ctx is done before it completes
+func (q *Query) RunContext(ctx context.Context, client *Client) (*Results, error) {
+	r, err := client.executePhantom(ctx, q.query, false)
 	if err != nil {
 		return nil, err
 	}
+	if r, err = client.checkOutput(q.query, r); err != nil {
+		return nil, err
+	}
 
-	return NewResults(r), nil
+	return NewResultsEncoding(r, client.resultsEncoding(nil)), nil
 }
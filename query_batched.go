@@ -3,6 +3,7 @@ package udt
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"text/template"
 
 	"github.com/hashicorp/go-uuid"
+	"golang.org/x/text/encoding"
 )
 
 // QueryConfig represents a query to be run against a Unidata database
@@ -19,12 +21,26 @@ type QueryConfig struct {
 	File      string
 	Fields    []string
 	BatchSize int
+
+	// DebugLevel controls the debug messages printed by the agent program, 0 disables them.
+	// Messages are passed to the client's Logger.
+	DebugLevel int
+
+	// Encoding overrides the client's encoding for decoding the XML results, see WithEncoding
+	Encoding encoding.Encoding
 }
 
 const defaultBatchSize = 10000
 
 // NewQueryBatched returns a queryBatched object that implements the RecordReader interface
 func NewQueryBatched(client *Client, query *QueryConfig) (*QueryBatched, error) {
+	return NewQueryBatchedContext(context.Background(), client, query)
+}
+
+// NewQueryBatchedContext is like NewQueryBatched but ctx governs the lifetime of the whole query.
+// Once ctx is done the agent process is killed and ReadRecord fails; Close must still be called to
+// remove the agent program from the server.
+func NewQueryBatchedContext(ctx context.Context, client *Client, query *QueryConfig) (*QueryBatched, error) {
 
 	// If we're not provided a BatchSize, use the default
 	if query.BatchSize <= 0 {
@@ -32,11 +48,13 @@ func NewQueryBatched(client *Client, query *QueryConfig) (*QueryBatched, error)
 	}
 
 	q := &QueryBatched{
+		ctx:    ctx,
 		client: client,
 		query:  query,
 	}
 
 	if err := q.run(); err != nil {
+		q.cleanup()
 		return nil, err
 	}
 
@@ -45,20 +63,28 @@ func NewQueryBatched(client *Client, query *QueryConfig) (*QueryBatched, error)
 
 // QueryBatched represents a batched query operation
 type QueryBatched struct {
+	ctx    context.Context
 	client *Client
 	query  *QueryConfig
 
 	err          error
 	queryUUID    string
 	udtProgName  string
+	udtProgSaved bool
 	udtProc      *UdtProc
 	procScanner  *bufio.Scanner
 	recordCount  int
 	batchCursor  int
+	batchNum     int
 	batchRecords RecordReader
+	batchObs     *observation
 }
 
 const udtProgFile = "BP"
+
+// agentProgPrefix starts the name of each agent program, which is only in udtProgFile while its
+// query runs
+const agentProgPrefix = "ETL-"
 const udtProgSrcTmpl = `
 $BASICTYPE "U"
 
@@ -84,34 +110,34 @@ QUERYID = {{.QueryId}}
 ** Ex: 10000
 BATCHSIZE = {{.BatchSize}}
 
-** Set DEBUG=1 to output debug messages
+** Set DEBUG>=1 to output debug messages
 DEBUG = {{.Debug}}
 
 ** ======
 
 CURSOR = 0
 
-IF DEBUG=1 THEN PRINT '|DEBUG|':SYSTEM(12):'|will run (':SELECTSCRIPT:') and retrieve results from (':LISTFILE:') in batches of (':BATCHSIZE:')'
+IF DEBUG>=1 THEN PRINT '|DEBUG|':SYSTEM(12):'|will run (':SELECTSCRIPT:') and retrieve results from (':LISTFILE:') in batches of (':BATCHSIZE:')'
 
-IF DEBUG=1 THEN PRINT '|DEBUG|':SYSTEM(12):'|select records'
+IF DEBUG>=1 THEN PRINT '|DEBUG|':SYSTEM(12):'|select records'
 GOSUB DOSELECT
-IF DEBUG=1 THEN PRINT '|DEBUG|':SYSTEM(12):'|selected ':RECORDCOUNT:' records'
+IF DEBUG>=1 THEN PRINT '|DEBUG|':SYSTEM(12):'|selected ':RECORDCOUNT:' records'
 PRINT '|SELECTED|':RECORDCOUNT
 
 BATCHI = 0
 LOOP WHILE BATCHI < RECORDCOUNT/BATCHSIZE DO
-  IF DEBUG=1 THEN PRINT '|DEBUG|':SYSTEM(12):'|build select list for batch ':BATCHI
+  IF DEBUG>=1 THEN PRINT '|DEBUG|':SYSTEM(12):'|build select list for batch ':BATCHI
 
   GOSUB DOGETNEXTBATCH
 
-  IF DEBUG=1 THEN PRINT '|DEBUG|':SYSTEM(12):'|list batch ':BATCHI
+  IF DEBUG>=1 THEN PRINT '|DEBUG|':SYSTEM(12):'|list batch ':BATCHI
 
   GOSUB DOLIST
 
   BATCHI += 1
 REPEAT
 
-IF DEBUG=1 THEN PRINT '|DEBUG|':SYSTEM(12):'|done'
+IF DEBUG>=1 THEN PRINT '|DEBUG|':SYSTEM(12):'|done'
 
 PRINT '|DONE'
 
@@ -163,13 +189,16 @@ EXIT:
 // Tprintf passed template string is formatted usign its operands and returns the resulting string.
 // Spaces are added between operands when neither is a string.
 // From: https://forum.golangbridge.org/t/named-string-formatting/3802/5
-func tprintf(tmpl string, data map[string]interface{}) string {
-	t := template.Must(template.New("udtsrc").Parse(tmpl))
+func tprintf(tmpl string, data map[string]interface{}) (string, error) {
+	t, err := template.New("udtsrc").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse UDT source template: %w", err)
+	}
 	buf := &bytes.Buffer{}
 	if err := t.Execute(buf, data); err != nil {
-		panic(fmt.Sprintf("Failed to render UDT source template: %s", err))
+		return "", fmt.Errorf("failed to render UDT source template: %w", err)
 	}
-	return buf.String()
+	return buf.String(), nil
 }
 
 func (q *QueryBatched) run() (err error) {
@@ -184,22 +213,26 @@ func (q *QueryBatched) run() (err error) {
 		quotedScript[i] = QuoteString(q.query.Select[i])
 	}
 
-	q.udtProgName = "ETL-" + q.queryUUID
-	progSrc := tprintf(udtProgSrcTmpl, map[string]interface{}{
+	q.udtProgName = agentProgPrefix + q.queryUUID
+	progSrc, err := tprintf(udtProgSrcTmpl, map[string]interface{}{
 		"SelectScript": quotedScript,
 		"ListFile":     QuoteString(q.query.File),
 		"FileFields":   QuoteString(strings.Join(q.query.Fields, " ")),
 		"QueryId":      QuoteString(q.queryUUID),
 		"BatchSize":    q.query.BatchSize,
-		"Debug":        1,
+		"Debug":        q.query.DebugLevel,
 	})
+	if err != nil {
+		return
+	}
 
-	if err = q.client.CompileBasicProgram(udtProgFile, q.udtProgName, progSrc); err != nil {
+	if err = q.client.CompileBasicProgramContext(q.ctx, udtProgFile, q.udtProgName, progSrc); err != nil {
 		return
 	}
+	q.udtProgSaved = true
 
 	// The -N option disables output paging and is required to capture output longer than one screen
-	q.udtProc, err = q.client.Execute(fmt.Sprintf("RUN %s %s -N", udtProgFile, q.udtProgName))
+	q.udtProc, err = q.client.ExecuteContext(q.ctx, fmt.Sprintf("RUN %s %s -N", udtProgFile, q.udtProgName))
 	if err != nil {
 		return
 	}
@@ -208,7 +241,11 @@ func (q *QueryBatched) run() (err error) {
 loop:
 	for q.procScanner.Scan() {
 		line := q.procScanner.Text()
-		if len(line) == 0 || line[0] != '|' {
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != '|' {
+			q.client.logger.LogAgent(q.queryUUID, line)
 			continue
 		}
 
@@ -217,14 +254,17 @@ loop:
 
 		switch parts[0] {
 		case "SELECTED":
+			if len(parts) < 2 {
+				return &AgentError{QueryID: q.queryUUID, Line: line, Err: errors.New("malformed SELECTED message")}
+			}
 			strCount := string(parts[1])
 			q.recordCount, err = strconv.Atoi(strCount)
 			if err != nil {
-				panic(fmt.Sprintf("Run: error parsing record count from SELECTED message. received (%s)", strCount))
+				return &AgentError{QueryID: q.queryUUID, Line: line, Err: fmt.Errorf("error parsing record count from SELECTED message: %w", err)}
 			}
 			break loop
-			//default:
-			//	log.Println("UDT Agent:", line)
+		default:
+			q.client.logger.LogAgent(q.queryUUID, line)
 		}
 	}
 	if err := q.procScanner.Err(); err != nil {
@@ -234,7 +274,14 @@ loop:
 	return
 }
 
-func (q *QueryBatched) getNextBatch() error {
+func (q *QueryBatched) getNextBatch() (err error) {
+
+	ctx, obs := q.client.startOp(q.ctx, OpBatch, fmt.Sprintf("%s/%d", q.queryUUID, q.batchNum))
+	defer func() {
+		if err != nil {
+			obs.end(err)
+		}
+	}()
 
 	batchSize := q.query.BatchSize
 	if q.recordCount-q.batchCursor < batchSize {
@@ -244,7 +291,11 @@ func (q *QueryBatched) getNextBatch() error {
 loop:
 	for q.procScanner.Scan() {
 		line := q.procScanner.Text()
-		if len(line) == 0 || line[0] != '|' {
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != '|' {
+			q.client.logger.LogAgent(q.queryUUID, line)
 			continue
 		}
 
@@ -253,24 +304,28 @@ loop:
 
 		switch parts[0] {
 		case "RESULTBATCH":
-			//log.Println("UDT Agent:", line)
+			if len(parts) < 3 {
+				return &AgentError{QueryID: q.queryUUID, Line: line, Err: errors.New("malformed RESULTBATCH message")}
+			}
 			path := parts[2]
 			// Assert the provided path is in the _XML_ sub-directory so we avoid accidentally
 			// deleting something important
 			if !strings.HasPrefix(parts[2], "_XML_/") {
-				panic(fmt.Sprintf("Unexpected file location given: %s", path))
+				return &AgentError{QueryID: q.queryUUID, Line: line, Err: fmt.Errorf("unexpected file location given: %s", path)}
 			}
 
-			f, err := q.client.RetrieveAndDeleteFile(path)
+			f, err := q.client.RetrieveAndDeleteFileContext(ctx, path)
 			if err != nil {
-				panic(fmt.Sprintf("Failed to retrieve file contents: %s", err))
+				return fmt.Errorf("failed to retrieve file contents: %w", err)
 			}
 
-			q.batchRecords = NewResults(f)
+			q.batchRecords = NewResultsEncoding(newHookedCloser(&observedReader{f, obs}, f.Close), q.client.resultsEncoding(q.query.Encoding))
+			q.batchObs = obs
+			q.batchNum++
 			q.batchCursor += batchSize
 			break loop
-			//default:
-			//	log.Println("UDT Agent:", line)
+		default:
+			q.client.logger.LogAgent(q.queryUUID, line)
 		}
 	}
 	if err := q.procScanner.Err(); err != nil {
@@ -294,34 +349,53 @@ func (q *QueryBatched) ReadRecord() (map[string]interface{}, error) {
 	// If we don't have a batch to read from, get one
 	if q.batchRecords == nil {
 		if err := q.getNextBatch(); err != nil {
-			return nil, fmt.Errorf("failed to fetch first batch of records: %s", err)
+			return nil, fmt.Errorf("failed to fetch first batch of records: %w", err)
 		}
 	}
 
-	record, err := q.batchRecords.ReadRecord()
+	record, err := q.readBatchRecord()
 
 	// If we've reached the end of this batch but we're not on the last batch
 	if err == io.EOF && q.batchCursor < q.recordCount {
-		if err := q.batchRecords.Close(); err != nil {
-			return nil, fmt.Errorf("failed to close record batch reader: %s", err)
+		if err := q.closeBatch(); err != nil {
+			return nil, fmt.Errorf("failed to close record batch reader: %w", err)
 		}
 
 		if err := q.getNextBatch(); err != nil {
-			return nil, fmt.Errorf("failed to fetch record batch [%d-%d]: %s", q.batchCursor, q.batchCursor+q.query.BatchSize, err)
+			return nil, fmt.Errorf("failed to fetch record batch [%d-%d]: %w", q.batchCursor, q.batchCursor+q.query.BatchSize, err)
 		}
 
-		return q.batchRecords.ReadRecord()
+		return q.readBatchRecord()
 	}
 
 	return record, err
 }
 
+// readBatchRecord reads a record from the current batch, counting it towards the batch's Event
+func (q *QueryBatched) readBatchRecord() (map[string]interface{}, error) {
+	record, err := q.batchRecords.ReadRecord()
+	if err == nil {
+		q.batchObs.ev.Records++
+	}
+	return record, err
+}
+
+// closeBatch closes the current batch and reports it to the client's Observer
+func (q *QueryBatched) closeBatch() error {
+	err := q.batchRecords.Close()
+	q.batchObs.end(err)
+	q.batchRecords = nil
+	q.batchObs = nil
+	return err
+}
+
 // Count returns the number of records that were selected
 func (q *QueryBatched) Count() int {
 	return q.recordCount
 }
 
-// Close closes the RecordReader
+// Close closes the RecordReader, removing the agent program and any result batches that weren't read
+// from the server
 func (q *QueryBatched) Close() error {
 
 	if q.err != nil {
@@ -329,15 +403,43 @@ func (q *QueryBatched) Close() error {
 	}
 	q.err = errors.New("record reader has already been closed")
 
+	var err error
 	if q.batchRecords != nil {
-		if err := q.batchRecords.Close(); err != nil {
-			return err
-		}
+		err = q.closeBatch()
 	}
 
-	if err := q.client.DeleteBasicProgram(udtProgFile, q.udtProgName); err != nil {
-		return err
+	if q.udtProc != nil {
+		_ = q.udtProc.Close()
 	}
 
+	// The agent program and batches are removed even if the query's context is done, otherwise a
+	// cancelled query would leave them behind on the server
+	if rmErr := q.removeBatches(); rmErr != nil && err == nil {
+		err = rmErr
+	}
+	if rmErr := q.client.DeleteBasicProgram(udtProgFile, q.udtProgName); rmErr != nil && err == nil {
+		err = rmErr
+	}
+
+	return err
+}
+
+// cleanup makes a best effort to remove anything left on the server by a failed run
+func (q *QueryBatched) cleanup() {
+	if q.udtProc != nil {
+		_ = q.udtProc.Close()
+		_ = q.removeBatches()
+	}
+	if q.udtProgSaved {
+		_ = q.client.DeleteBasicProgram(udtProgFile, q.udtProgName)
+	}
+}
+
+// removeBatches removes the result batches the agent has written but that haven't been retrieved
+func (q *QueryBatched) removeBatches() error {
+	pattern := shellQuote(q.client.env.UdtAcct+"/_XML_/"+q.queryUUID+"_") + "*"
+	if _, err := q.client.shellOutput(context.Background(), "rm -f "+pattern); err != nil {
+		return fmt.Errorf("failed to remove result batches: %w", err)
+	}
 	return nil
 }
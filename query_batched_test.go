@@ -0,0 +1,87 @@
+package udt
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// waitForFiles waits for the agent to write n files to dir
+func waitForFiles(t *testing.T, dir string, n int) {
+	t.Helper()
+
+	for i := 0; i < 500; i++ {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d files in %s", n, dir)
+}
+
+func TestQueryBatchedCloseEarly(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	q, err := NewQueryBatched(c, &QueryConfig{File: "ORDERS", Fields: []string{"ID"}, BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.ReadRecord(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first batch has been retrieved, the other two are still waiting on the server
+	waitForFiles(t, env.UdtAcct+"/_XML_", 2)
+
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertDirEmpty(t, env.UdtAcct+"/_XML_")
+	assertDirEmpty(t, env.UdtAcct+"/BP")
+}
+
+func TestQueryBatchedCancel(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q, err := NewQueryBatchedContext(ctx, c, &QueryConfig{File: "ORDERS", Fields: []string{"ID"}, BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.ReadRecord(); err != nil {
+		t.Fatal(err)
+	}
+	waitForFiles(t, env.UdtAcct+"/_XML_", 2)
+
+	cancel()
+
+	// The rest of the current batch may already have been read, but the next one can't be fetched
+	for {
+		_, err := q.ReadRecord()
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected %v, received %v", context.Canceled, err)
+		}
+		break
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertDirEmpty(t, env.UdtAcct+"/_XML_")
+	assertDirEmpty(t, env.UdtAcct+"/BP")
+}
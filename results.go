@@ -7,20 +7,38 @@ import (
 	"io"
 	"strings"
 
+	"golang.org/x/text/encoding"
 	"golang.org/x/text/encoding/charmap"
 )
 
-// NewResults reads XML data and constructs a Results object from it
+// NewResults reads ISO-8859-1 encoded XML data and constructs a Results object from it
 func NewResults(xmlResults io.ReadCloser) *Results {
+	return NewResultsEncoding(xmlResults, charmap.ISO8859_1)
+}
 
-	r := charmap.ISO8859_1.NewDecoder().Reader(xmlResults)
+// NewResultsEncoding is like NewResults but the XML data is decoded with enc, which may be an
+// AutoEncoding
+func NewResultsEncoding(xmlResults io.ReadCloser, enc encoding.Encoding) *Results {
+
+	var r io.Reader = xmlResults
+	var err error
+	if auto, ok := enc.(*autoEncoding); ok {
+		r, enc, err = detectXMLEncoding(r, auto.Encoding)
+	}
+	if enc != nil {
+		r = enc.NewDecoder().Reader(r)
+	}
 
 	d := xml.NewDecoder(r)
+	// The data has already been decoded to UTF-8, whatever the prolog says
+	d.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
 
 	return &Results{
 		closer:  xmlResults,
 		decoder: d,
-		err:     nil,
+		err:     err,
 	}
 }
 
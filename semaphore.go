@@ -0,0 +1,75 @@
+package udt
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// semaphore limits concurrent access to a resource. Waiters are granted the resource in the order
+// they arrived. A nil *semaphore places no limit.
+type semaphore struct {
+	mu      sync.Mutex
+	size    int
+	cur     int
+	waiters list.List
+}
+
+// newSemaphore returns a semaphore allowing n concurrent holders, or nil if n <= 0
+func newSemaphore(n int) *semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return &semaphore{size: n}
+}
+
+// acquire blocks until the semaphore is acquired or ctx is done
+func (s *semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	if s.cur < s.size && s.waiters.Len() == 0 {
+		s.cur++
+		s.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	elem := s.waiters.PushBack(ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-ready:
+			// We were granted the semaphore just as ctx was done, pass it on
+			s.mu.Unlock()
+			s.release()
+		default:
+			s.waiters.Remove(elem)
+			s.mu.Unlock()
+		}
+		return ctx.Err()
+	}
+}
+
+// release releases the semaphore, handing it to the longest waiting goroutine if there is one
+func (s *semaphore) release() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if front := s.waiters.Front(); front != nil {
+		s.waiters.Remove(front)
+		close(front.Value.(chan struct{}))
+		return
+	}
+	s.cur--
+}
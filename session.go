@@ -0,0 +1,323 @@
+package udt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+)
+
+const (
+	// sessionPrompt is the ECL prompt printed by udt when it is ready for a statement
+	sessionPrompt = ":"
+
+	// sessionQuitTimeout is how long Close waits for udt to exit after sending QUIT
+	sessionQuitTimeout = 5 * time.Second
+
+	sessionTerm   = "dumb"
+	sessionHeight = 24
+	sessionWidth  = 512
+)
+
+// errSessionClosed is returned when using a Session that has been closed
+var errSessionClosed = errors.New("udt session has been closed")
+
+// Session is a single udt process that stays open between statements. The cost of starting udt
+// is paid once, and state such as active select lists and the account chosen by LOGTO carries over
+// from one statement to the next.
+//
+// udt is run on a pseudo-terminal when the Transport supports it (the SSH transport does, the
+// local transport doesn't). The end of each statement's output is found by waiting for udt to
+// prompt for the next statement, then sending a DISPLAY of a unique marker and waiting for the
+// marker to be printed; the echoed input and ECL prompts are removed from the output.
+//
+// A statement that asks a question, such as CLEAR.FILE, never gets back to the prompt, so Execute
+// waits for it forever; ExecuteContext gives up when its context is done, ending the session. Use
+// Client.ExecuteInteractive to answer questions.
+//
+// A Session holds one of the client's sessions until it is closed. It is safe for concurrent use,
+// statements are run one at a time.
+type Session struct {
+	client *Client
+	cmd    Cmd
+	stdin  io.WriteCloser
+	lines  chan sessionLine
+	done   chan struct{}
+
+	// pty is set when udt is running on a pseudo-terminal, which may echo our input
+	pty bool
+
+	mu     sync.Mutex
+	closed bool
+
+	// broken is set when the state of udt is no longer known, e.g. after an Execute was cancelled
+	broken error
+}
+
+type sessionLine struct {
+	text string
+	err  error
+
+	// partial is set when output stopped part way through the line, e.g. at a prompt. The whole
+	// line is passed on again once it ends.
+	partial bool
+}
+
+// NewSession starts a udt process in the client's account for running a series of statements
+func (c *Client) NewSession() (*Session, error) {
+	return c.NewSessionContext(context.Background())
+}
+
+// NewSessionContext is like NewSession but gives up on starting udt if ctx is done
+func (c *Client) NewSessionContext(ctx context.Context) (_ *Session, err error) {
+
+	cmd, err := c.command(ctx, c.udtShellCmd())
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = cmd.Close()
+		}
+	}()
+
+	pty := false
+	if ptyCmd, ok := cmd.(PTYCmd); ok {
+		err := ptyCmd.RequestPTY(sessionTerm, sessionHeight, sessionWidth)
+		if err != nil && err != errPTYUnsupported {
+			return nil, fmt.Errorf("failed to request a pseudo-terminal: %w", err)
+		}
+		pty = err == nil
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach to stdin pipe: %s", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach to stdout pipe: %s", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, &CommandError{Command: c.udtShellCmd(), Err: err}
+	}
+
+	s := &Session{
+		client: c,
+		cmd:    cmd,
+		stdin:  c.encodeWriter(stdin),
+		lines:  make(chan sessionLine),
+		done:   make(chan struct{}),
+		pty:    pty,
+	}
+	go s.readLines(c.decodeReader(stdout))
+
+	// Discard the login banner, waiting until udt is ready for statements
+	if _, err := s.exchange(ctx, ""); err != nil {
+		close(s.done)
+		return nil, fmt.Errorf("failed to start udt session: %w", err)
+	}
+
+	return s, nil
+}
+
+// Execute runs an ECL statement and returns its output
+func (s *Session) Execute(statement string) (string, error) {
+	return s.ExecuteContext(context.Background(), statement)
+}
+
+// ExecuteContext is like Execute but gives up waiting for the statement to finish if ctx is done.
+// As the state of udt is then unknown, the session is terminated and can't be used again.
+func (s *Session) ExecuteContext(ctx context.Context, statement string) (_ string, err error) {
+
+	if strings.ContainsAny(statement, "\r\n") {
+		return "", fmt.Errorf("statement must be a single line: %q", statement)
+	}
+	// Check the statement can be encoded, as failing part way through writing it breaks the session
+	if _, err := s.client.encodeString(statement); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return "", errSessionClosed
+	}
+	if s.broken != nil {
+		return "", fmt.Errorf("udt session is unusable: %w", s.broken)
+	}
+
+	ctx, obs := s.client.startOp(ctx, OpStatement, statement)
+	defer func() { obs.end(err) }()
+
+	return s.exchange(ctx, statement)
+}
+
+// exchange sends statement, or nothing if it is blank, and returns the output up to the prompt
+// that follows it
+func (s *Session) exchange(ctx context.Context, statement string) (string, error) {
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", err
+	}
+	marker := "UDTSESSION" + strings.Replace(id, "-", "", -1)
+	markerStatement := "DISPLAY " + marker
+
+	// The marker is only sent once udt is back at the prompt, so it can't be taken as the answer to
+	// a question asked by the statement
+	input := statement + "\n"
+	markerSent := statement == ""
+	if markerSent {
+		input = markerStatement + "\n"
+	}
+	if _, err := io.WriteString(s.stdin, input); err != nil {
+		s.broken = err
+		return "", &CommandError{Command: statement, Err: err}
+	}
+
+	var output []string
+	received := 0
+	for {
+		var line sessionLine
+		select {
+		case line = <-s.lines:
+		case <-ctx.Done():
+			s.broken = ctx.Err()
+			_ = s.cmd.Kill()
+			return "", ctx.Err()
+		}
+
+		if line.err != nil {
+			s.broken = line.err
+			return "", &CommandError{Command: statement, Output: strings.Join(output, "\n"), Err: fmt.Errorf("udt exited: %w", line.err)}
+		}
+
+		if line.partial {
+			if !markerSent && atPrompt(line.text, received == 0) {
+				if _, err := io.WriteString(s.stdin, markerStatement+"\n"); err != nil {
+					s.broken = err
+					return "", &CommandError{Command: statement, Err: err}
+				}
+				markerSent = true
+			}
+			continue
+		}
+		received++
+
+		text := strings.TrimRight(line.text, "\r\n")
+		unprompted := strings.TrimLeft(text, sessionPrompt)
+		if unprompted == marker {
+			break
+		}
+
+		// Drop the echo of our input
+		if s.pty && (unprompted == markerStatement || len(output) == 0 && statement != "" && unprompted == statement) {
+			continue
+		}
+		// The first line of output follows the prompt that udt printed before reading the statement
+		if len(output) == 0 {
+			text = strings.TrimPrefix(text, sessionPrompt)
+		}
+		output = append(output, text)
+	}
+
+	if len(output) == 0 {
+		return "", nil
+	}
+	return strings.Join(output, "\n") + "\n", nil
+}
+
+// atPrompt reports whether a partial line of output is a new ECL prompt. Until the first whole line
+// of a statement's output, lines start with the prompt udt printed before reading the statement.
+func atPrompt(text string, first bool) bool {
+	text = strings.TrimRight(text, "\r")
+	if first {
+		text = strings.TrimPrefix(text, sessionPrompt)
+	}
+	return text == sessionPrompt
+}
+
+// readLines passes each line of udt's output to the lines channel until the output ends. When the
+// output stops part way through a line, the line so far is passed on as a partial line.
+func (s *Session) readLines(stdout io.Reader) {
+	buf := make([]byte, 4096)
+	var pending []byte
+	for {
+		n, err := stdout.Read(buf)
+		pending = append(pending, buf[:n]...)
+
+		for {
+			i := bytes.IndexByte(pending, '\n')
+			if i < 0 {
+				break
+			}
+			if !s.sendLine(sessionLine{text: string(pending[:i+1])}) {
+				return
+			}
+			pending = pending[i+1:]
+		}
+
+		if err != nil {
+			if len(pending) > 0 && !s.sendLine(sessionLine{text: string(pending)}) {
+				return
+			}
+			s.sendLine(sessionLine{err: err})
+			return
+		}
+
+		// A short read means udt has stopped writing for now
+		if len(pending) > 0 && n < len(buf) {
+			if !s.sendLine(sessionLine{text: string(pending), partial: true}) {
+				return
+			}
+		}
+	}
+}
+
+// sendLine passes a line to the lines channel, returning false if the session has been closed
+func (s *Session) sendLine(line sessionLine) bool {
+	select {
+	case s.lines <- line:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// Close ends the udt process, asking it to QUIT and terminating it if it doesn't exit promptly
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+
+	if s.broken == nil {
+		_, _ = io.WriteString(s.stdin, "QUIT\n")
+	}
+	_ = s.stdin.Close()
+
+	exited := make(chan struct{})
+	go func() {
+		_ = s.cmd.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(sessionQuitTimeout):
+	}
+
+	return s.cmd.Close()
+}
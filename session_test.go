@@ -0,0 +1,116 @@
+package udt
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSession(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t, WithMaxSessions(1))
+	defer cleanup()
+
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := filepath.Join(env.UdtHome, "other")
+	if err := os.MkdirAll(other, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		statement string
+		expected  string
+	}{
+		{"WHERE", env.UdtAcct + "\n"},
+		{"LIST ORDERS", "LIST ORDERS\n"},
+		{"SELECT ORDERS", "\n5 records selected to list 0.\n\n"},
+		{"LIST ORDERS", "LIST ORDERS using the select list of ORDERS\n"},
+		{"LOGTO " + other, ""},
+		{"WHERE", other + "\n"},
+		{":COLON", ":COLON\n"},
+	}
+
+	for _, test := range tests {
+		out, err := s.Execute(test.statement)
+		if err != nil {
+			t.Fatalf("%s: %s", test.statement, err)
+		}
+		if out != test.expected {
+			t.Errorf("%s: expected %q, received %q", test.statement, test.expected, out)
+		}
+	}
+
+	if _, err := s.Execute("WHERE\nWHERE"); err == nil {
+		t.Error("expected an error for a multi-line statement")
+	}
+
+	// The session holds the client's only session until it is closed
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.ExecuteContext(ctx, "WHAT"); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v while the session is open, received %v", context.DeadlineExceeded, err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Execute("WHERE"); err != errSessionClosed {
+		t.Fatalf("expected %v, received %v", errSessionClosed, err)
+	}
+
+	proc, err := c.Execute("WHAT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc.Close()
+}
+
+func TestSessionContext(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.ExecuteContext(ctx, "SLEEP 10"); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, received %v", context.DeadlineExceeded, err)
+	}
+
+	if _, err := s.Execute("WHERE"); err == nil {
+		t.Fatal("expected an error using a session after a cancelled statement")
+	}
+}
+
+func TestSessionQuestion(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// The statement never gets back to the prompt, and nothing is sent to answer its question
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := s.ExecuteContext(ctx, "CLEAR.FILE ORDERS"); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, received %v", context.DeadlineExceeded, err)
+	}
+	if _, err := os.Stat(filepath.Join(env.UdtAcct, "CLEAR.FILE.answer")); !os.IsNotExist(err) {
+		t.Errorf("the question was answered: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package udt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// shellQuote quotes s so that a POSIX shell treats it as a single literal word. The string is
+// wrapped in single quotes, inside which the shell performs no expansion at all. A single quote
+// within s is written by closing the quoted string, adding an escaped quote and reopening it:
+//
+//	it's  ->  'it'\''s'
+func shellQuote(s string) string {
+	return `'` + strings.Replace(s, `'`, `'\''`, -1) + `'`
+}
+
+// shellJoin quotes each of args and joins them into a shell command line
+func shellJoin(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// udtShellCmd builds a shell command line that runs udt in the client's account with the given
+// arguments. Every value is quoted so it reaches udt exactly as provided.
+func (c *Client) udtShellCmd(args ...string) string {
+	return fmt.Sprintf(`UDTHOME=%s; UDTBIN=%s; export UDTHOME UDTBIN; cd %s && exec "$UDTBIN/udt" %s`,
+		shellQuote(c.env.UdtHome),
+		shellQuote(c.env.UdtBin),
+		shellQuote(c.env.UdtAcct),
+		shellJoin(args...),
+	)
+}
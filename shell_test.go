@@ -0,0 +1,126 @@
+package udt
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// hostileShellInputs are strings that would be expanded, split or otherwise mangled by a shell if
+// they were not quoted correctly
+var hostileShellInputs = []string{
+	"",                  // 0  - empty
+	" ",                 // 1  - whitespace only
+	"a b  c",            // 2  - word splitting
+	"\t\n",              // 3  - tab and newline
+	"line1\nline2",      // 4  - embedded newline
+	"$HOME",             // 5  - parameter expansion
+	"${HOME}",           // 6  - braced parameter expansion
+	"$(id)",             // 7  - command substitution
+	"`id`",              // 8  - backtick command substitution
+	"$((1+1))",          // 9  - arithmetic expansion
+	`\`,                 // 10 - lone backslash
+	`\\n`,               // 11 - escaped backslash
+	`'`,                 // 12 - lone single quote
+	`''`,                // 13 - empty single quoted string
+	`"`,                 // 14 - lone double quote
+	`'"'"'`,             // 15 - alternating quotes
+	`it's "quoted"`,     // 16 - mixed quotes
+	"*",                 // 17 - glob
+	"?[a-z]",            // 18 - glob classes
+	"~",                 // 19 - tilde expansion
+	"{a,b}",             // 20 - brace expansion
+	"; echo pwned",      // 21 - command separator
+	"&& echo pwned",     // 22 - and list
+	"| cat",             // 23 - pipe
+	"> /tmp/x < /tmp/y", // 24 - redirection
+	"# comment",         // 25 - comment
+	"!",                 // 26 - history expansion
+	"-n",                // 27 - looks like an option
+	"%s %d",             // 28 - printf verbs
+	"\x01\x7f",          // 29 - control characters
+	"café ½",            // 30 - non-ASCII
+	`SELECT ORDERS WITH ORD_DATE="10/25/2000"`,  // 31 - ECL statement
+	`LIST CLIENTS WITH NAME = "O'Brien" AND $X`, // 32 - ECL statement with quotes and $
+}
+
+func TestShellQuote(t *testing.T) {
+
+	for i, in := range hostileShellInputs {
+		out, err := exec.Command("/bin/sh", "-c", "printf '%s' "+shellQuote(in)).Output()
+		if err != nil {
+			t.Errorf("hostileShellInputs[%d]: %s", i, err)
+			continue
+		}
+
+		assertEqual(t, []byte(in), out, fmt.Sprintf("hostileShellInputs[%d], input: %q", i, in))
+	}
+}
+
+func TestShellJoin(t *testing.T) {
+
+	script := shellJoin(append([]string{"printf", `%s\0`}, hostileShellInputs...)...)
+	out, err := exec.Command("/bin/sh", "-c", script).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []byte
+	for _, in := range hostileShellInputs {
+		expected = append(append(expected, in...), 0)
+	}
+
+	assertEqual(t, expected, out, "joined hostileShellInputs")
+}
+
+func TestUdtShellCmd(t *testing.T) {
+
+	// Lay out a fake UniData installation whose paths need quoting, with a udt binary that prints
+	// its environment, working directory and arguments
+	dir, err := ioutil.TempDir("", "udt-shell-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	env := &EnvConfig{
+		UdtHome: filepath.Join(dir, "ud home $HOME"),
+		UdtBin:  filepath.Join(dir, "ud home $HOME", "b`i`n"),
+		UdtAcct: filepath.Join(dir, "it's an account"),
+	}
+	for _, d := range []string{env.UdtBin, env.UdtAcct} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	udtSrc := "#!/bin/sh\nprintf '%s\\0' \"$UDTHOME\" \"$UDTBIN\" \"$(pwd)\" \"$@\"\n"
+	if err := ioutil.WriteFile(filepath.Join(env.UdtBin, "udt"), []byte(udtSrc), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Client{env: env}
+
+	for i, in := range hostileShellInputs {
+		out, err := exec.Command("/bin/sh", "-c", c.udtShellCmd("PHANTOM", in)).Output()
+		if err != nil {
+			t.Errorf("hostileShellInputs[%d]: %s", i, err)
+			continue
+		}
+
+		expected := bytes.Join([][]byte{
+			[]byte(env.UdtHome), []byte(env.UdtBin), []byte(env.UdtAcct), []byte("PHANTOM"), []byte(in), nil,
+		}, []byte{0})
+		assertEqual(t, expected, out, fmt.Sprintf("hostileShellInputs[%d], input: %q", i, in))
+	}
+}
+
+func assertEqual(t *testing.T, expected []byte, received []byte, failMsg string) {
+	t.Helper()
+	if !bytes.Equal(expected, received) {
+		t.Fatalf("Unexpected value: %s\nExpected:\n%q\nReceived:\n%q\n", failMsg, expected, received)
+	}
+}
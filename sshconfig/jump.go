@@ -0,0 +1,110 @@
+package sshconfig
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Hop is a jump host on the way to an SSH server
+type Hop struct {
+	// Addr is the host:port of the jump host
+	Addr string
+
+	// Config is used to verify and authenticate with the jump host
+	Config *ssh.ClientConfig
+}
+
+// JumpDialer returns a function, with the signature of ssh.Dial, that connects to the server by
+// tunnelling through each of the hops in turn. Closing the returned client closes the connections
+// to the hops as well.
+func JumpDialer(hops ...Hop) func(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	return func(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+
+		if len(hops) == 0 {
+			return ssh.Dial(network, addr, config)
+		}
+
+		var chain []*ssh.Client
+		closeChain := func() {
+			for i := len(chain) - 1; i >= 0; i-- {
+				chain[i].Close()
+			}
+		}
+
+		client, err := ssh.Dial(network, hops[0].Addr, hops[0].Config)
+		if err != nil {
+			return nil, fmt.Errorf("sshconfig: failed to connect to jump host %s: %w", hops[0].Addr, err)
+		}
+		chain = append(chain, client)
+
+		for _, hop := range hops[1:] {
+			client, err := dialVia(chain[len(chain)-1], network, hop.Addr, hop.Config)
+			if err != nil {
+				closeChain()
+				return nil, fmt.Errorf("sshconfig: failed to connect to jump host %s: %w", hop.Addr, err)
+			}
+			chain = append(chain, client)
+		}
+
+		conn, chans, reqs, err := dialConnVia(chain[len(chain)-1], network, addr, config)
+		if err != nil {
+			closeChain()
+			return nil, err
+		}
+
+		return ssh.NewClient(&jumpConn{Conn: conn, chain: chain}, chans, reqs), nil
+	}
+}
+
+// dialVia connects to the SSH server at addr through an established client connection
+func dialVia(via *ssh.Client, network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, chans, reqs, err := dialConnVia(via, network, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewClient(conn, chans, reqs), nil
+}
+
+func dialConnVia(via *ssh.Client, network, addr string, config *ssh.ClientConfig) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	netConn, err := via.Dial(network, addr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	conn, chans, reqs, err := ssh.NewClientConn(netConn, addr, config)
+	if err != nil {
+		netConn.Close()
+		return nil, nil, nil, err
+	}
+	return conn, chans, reqs, nil
+}
+
+// jumpConn is the connection to the target server. The chain of jump hosts is torn down when the
+// connection is closed or lost.
+type jumpConn struct {
+	ssh.Conn
+	chain     []*ssh.Client
+	closeOnce sync.Once
+}
+
+func (c *jumpConn) Close() error {
+	err := c.Conn.Close()
+	c.closeChain()
+	return err
+}
+
+func (c *jumpConn) Wait() error {
+	err := c.Conn.Wait()
+	c.closeChain()
+	return err
+}
+
+func (c *jumpConn) closeChain() {
+	c.closeOnce.Do(func() {
+		for i := len(c.chain) - 1; i >= 0; i-- {
+			c.chain[i].Close()
+		}
+	})
+}
@@ -0,0 +1,406 @@
+// Package sshconfig builds ssh.ClientConfigs that verify the server's host key and authenticate
+// with ssh-agent, private key files, SSH certificates or a password, and dials SSH servers through
+// chains of jump hosts like OpenSSH's ProxyJump.
+package sshconfig
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Config describes how to verify and authenticate with an SSH server. When Agent is set, the
+// connection to ssh-agent is opened by the first ClientConfig or Dialer and shared by everything
+// they return; Close closes it once no more connections will be made.
+type Config struct {
+	User string
+
+	// Agent authenticates with the keys held by the ssh-agent listening on SSH_AUTH_SOCK
+	Agent bool
+
+	// KeyFiles are private key files to authenticate with. Encrypted keys are decrypted with
+	// Passphrase. A certificate found next to a key file, named as OpenSSH expects (id_ed25519 and
+	// id_ed25519-cert.pub), is offered before the plain key.
+	KeyFiles   []string
+	Passphrase string
+
+	// CertFiles are SSH certificates to offer in place of the plain keys they certify. Each must
+	// certify one of the keys in KeyFiles.
+	CertFiles []string
+
+	Password string
+
+	// KnownHostsFiles are the known_hosts files the server's host key is verified against,
+	// including @cert-authority entries. When no host key policy is set ~/.ssh/known_hosts is used.
+	KnownHostsFiles []string
+
+	// Fingerprints are acceptable SHA256 fingerprints of the server's host key, as printed by
+	// ssh-keygen -l
+	Fingerprints []string
+
+	// InsecureIgnoreHostKey accepts any host key. It leaves the connection open to
+	// man-in-the-middle attacks and should only be used for testing.
+	InsecureIgnoreHostKey bool
+
+	// ProxyJump is a comma separated list of jump hosts ([user@]host[:port]) to connect through,
+	// in the order they are visited. Each is verified and authenticated like the target server,
+	// using User when the hop doesn't name one.
+	ProxyJump string
+
+	// Timeout limits the time taken to establish each connection
+	Timeout time.Duration
+
+	agentMu   sync.Mutex
+	agentAuth ssh.AuthMethod
+	agentConn io.Closer
+}
+
+// ClientConfig builds an ssh.ClientConfig for connecting to the server at addr (host:port). The
+// address is used to prefer the host key algorithms recorded for the server in known_hosts.
+func (c *Config) ClientConfig(addr string) (*ssh.ClientConfig, error) {
+	return c.clientConfig(addr, c.User)
+}
+
+// clientConfig is ClientConfig for the given user, used for jump hosts naming their own user
+func (c *Config) clientConfig(addr string, user string) (*ssh.ClientConfig, error) {
+
+	auth, err := c.authMethods()
+	if err != nil {
+		return nil, err
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("sshconfig: no authentication method configured")
+	}
+
+	hostKeyCallback, algorithms, err := c.hostKeyCallback(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:              user,
+		Auth:              auth,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: algorithms,
+		Timeout:           c.Timeout,
+	}, nil
+}
+
+// Dialer returns a function, with the signature of ssh.Dial, that connects through the configured
+// jump hosts. It returns ssh.Dial when ProxyJump is blank.
+func (c *Config) Dialer() (func(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error), error) {
+
+	if c.ProxyJump == "" {
+		return ssh.Dial, nil
+	}
+
+	var hops []Hop
+	for _, spec := range strings.Split(c.ProxyJump, ",") {
+		user, addr, err := parseJumpSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		if user == "" {
+			user = c.User
+		}
+		clientCfg, err := c.clientConfig(addr, user)
+		if err != nil {
+			return nil, fmt.Errorf("sshconfig: jump host %s: %w", addr, err)
+		}
+		hops = append(hops, Hop{Addr: addr, Config: clientCfg})
+	}
+
+	return JumpDialer(hops...), nil
+}
+
+// Close closes the connection to ssh-agent, if one was opened. ClientConfigs built before Close can
+// no longer authenticate with the agent, while a later ClientConfig or Dialer opens a new connection.
+func (c *Config) Close() error {
+	c.agentMu.Lock()
+	defer c.agentMu.Unlock()
+
+	if c.agentConn == nil {
+		return nil
+	}
+	err := c.agentConn.Close()
+	c.agentAuth, c.agentConn = nil, nil
+	return err
+}
+
+// parseJumpSpec parses a [user@]host[:port] jump host specification
+func parseJumpSpec(spec string) (user string, addr string, err error) {
+	spec = strings.TrimSpace(spec)
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		user, spec = spec[:i], spec[i+1:]
+	}
+	if spec == "" {
+		return "", "", errors.New("sshconfig: empty jump host in ProxyJump")
+	}
+	if _, _, err := net.SplitHostPort(spec); err != nil {
+		spec = net.JoinHostPort(strings.Trim(spec, "[]"), "22")
+	}
+	return user, spec, nil
+}
+
+func (c *Config) authMethods() ([]ssh.AuthMethod, error) {
+
+	var methods []ssh.AuthMethod
+
+	if c.Agent {
+		method, err := c.agentMethod()
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, method)
+	}
+
+	var signers []ssh.Signer
+	for _, path := range c.KeyFiles {
+		signer, err := LoadKey(path, c.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, certPath := range c.CertFiles {
+			certSigner, err := LoadCertificate(signer, certPath)
+			if err == errCertMismatch {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			signers = append(signers, certSigner)
+		}
+
+		certSigner, err := LoadCertificate(signer, ExpandHome(path)+"-cert.pub")
+		switch {
+		case err == nil:
+			signers = append(signers, certSigner)
+		case !os.IsNotExist(errors.Unwrap(err)):
+			return nil, err
+		}
+
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if c.Password != "" {
+		methods = append(methods, ssh.Password(c.Password))
+	}
+
+	return methods, nil
+}
+
+// agentMethod returns the AuthMethod for ssh-agent, connecting to the agent the first time
+func (c *Config) agentMethod() (ssh.AuthMethod, error) {
+	c.agentMu.Lock()
+	defer c.agentMu.Unlock()
+
+	if c.agentAuth == nil {
+		method, conn, err := AgentAuth()
+		if err != nil {
+			return nil, err
+		}
+		c.agentAuth, c.agentConn = method, conn
+	}
+	return c.agentAuth, nil
+}
+
+// AgentAuth returns an AuthMethod that authenticates with the keys held by the ssh-agent listening
+// on SSH_AUTH_SOCK, along with the connection to the agent. The AuthMethod stops working once the
+// connection is closed, so close it after the last connection using the AuthMethod is established.
+func AgentAuth() (ssh.AuthMethod, io.Closer, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, nil, errors.New("sshconfig: SSH_AUTH_SOCK is not set, is ssh-agent running?")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, nil, fmt.Errorf("sshconfig: failed to connect to ssh-agent: %w", err)
+	}
+	return ssh.PublicKeysCallback(agent.NewClient(conn).Signers), conn, nil
+}
+
+// LoadKey reads a private key file, decrypting it with passphrase if it is encrypted
+func LoadKey(path string, passphrase string) (ssh.Signer, error) {
+	buf, err := ioutil.ReadFile(ExpandHome(path))
+	if err != nil {
+		return nil, fmt.Errorf("sshconfig: failed to read private key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(buf)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		if passphrase == "" {
+			return nil, fmt.Errorf("sshconfig: private key %s is encrypted and no passphrase was given", path)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(buf, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sshconfig: failed to parse private key %s: %w", path, err)
+	}
+
+	return signer, nil
+}
+
+var errCertMismatch = errors.New("sshconfig: certificate does not certify the key")
+
+// LoadCertificate reads an SSH certificate for the key held by signer and returns a Signer that
+// offers the certificate
+func LoadCertificate(signer ssh.Signer, path string) (ssh.Signer, error) {
+	buf, err := ioutil.ReadFile(ExpandHome(path))
+	if err != nil {
+		return nil, fmt.Errorf("sshconfig: failed to read certificate: %w", err)
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("sshconfig: failed to parse certificate %s: %w", path, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("sshconfig: %s is not an SSH certificate", path)
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, errCertMismatch
+	}
+	return certSigner, nil
+}
+
+func (c *Config) hostKeyCallback(addr string) (ssh.HostKeyCallback, []string, error) {
+
+	if c.InsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	}
+
+	if len(c.Fingerprints) > 0 && len(c.KnownHostsFiles) == 0 {
+		return FingerprintCallback(c.Fingerprints...), nil, nil
+	}
+
+	files := c.KnownHostsFiles
+	if len(files) == 0 {
+		files = []string{"~/.ssh/known_hosts"}
+	}
+	callback, err := KnownHostsCallback(files...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(c.Fingerprints) > 0 {
+		// Accept a key listed in known_hosts or matching one of the fingerprints
+		knownHosts, fingerprints := callback, FingerprintCallback(c.Fingerprints...)
+		callback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if err := fingerprints(hostname, remote, key); err == nil {
+				return nil
+			}
+			return knownHosts(hostname, remote, key)
+		}
+	}
+
+	return callback, knownHostKeyAlgorithms(callback, addr), nil
+}
+
+// KnownHostsCallback returns a HostKeyCallback that verifies host keys against the given
+// known_hosts files
+func KnownHostsCallback(files ...string) (ssh.HostKeyCallback, error) {
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = ExpandHome(f)
+	}
+
+	callback, err := knownhosts.New(paths...)
+	if err != nil {
+		return nil, fmt.Errorf("sshconfig: failed to load known_hosts: %w", err)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		if keyErr, ok := err.(*knownhosts.KeyError); ok {
+			if len(keyErr.Want) == 0 {
+				return fmt.Errorf("sshconfig: host %s is not in known_hosts (%s key %s): %w", hostname, key.Type(), ssh.FingerprintSHA256(key), err)
+			}
+			return fmt.Errorf("sshconfig: host key for %s does not match known_hosts, possible man-in-the-middle attack (%s key %s): %w", hostname, key.Type(), ssh.FingerprintSHA256(key), err)
+		}
+		return err
+	}, nil
+}
+
+// FingerprintCallback returns a HostKeyCallback that accepts host keys with one of the given SHA256
+// fingerprints
+func FingerprintCallback(fingerprints ...string) ssh.HostKeyCallback {
+	return func(hostname string, _ net.Addr, key ssh.PublicKey) error {
+		fp := ssh.FingerprintSHA256(key)
+		for _, want := range fingerprints {
+			if fp == want {
+				return nil
+			}
+		}
+		return fmt.Errorf("sshconfig: host key fingerprint for %s is %s, expected one of %s", hostname, fp, strings.Join(fingerprints, ", "))
+	}
+}
+
+// knownHostKeyAlgorithms returns the host key algorithms of the keys recorded for addr, so that the
+// server is asked for a key that can be verified. It returns nil, allowing any algorithm, when addr
+// isn't known.
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback, addr string) []string {
+	if addr == "" {
+		return nil
+	}
+
+	// The callback reports the keys it expected when presented with a key it doesn't know
+	err := callback(addr, &net.TCPAddr{IP: net.IPv4zero}, probeKey{})
+	keyErr := &knownhosts.KeyError{}
+	if !errors.As(err, &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, known := range keyErr.Want {
+		types := []string{known.Key.Type()}
+		if types[0] == ssh.KeyAlgoRSA {
+			types = []string{ssh.SigAlgoRSASHA2512, ssh.SigAlgoRSASHA2256, ssh.KeyAlgoRSA}
+		}
+		for _, t := range types {
+			if !seen[t] {
+				seen[t] = true
+				algorithms = append(algorithms, t)
+			}
+		}
+	}
+	return algorithms
+}
+
+// probeKey is a public key that never matches a known_hosts entry
+type probeKey struct{}
+
+func (probeKey) Type() string                                 { return "probe" }
+func (probeKey) Marshal() []byte                              { return []byte("probe") }
+func (probeKey) Verify(data []byte, sig *ssh.Signature) error { return errors.New("probe key") }
+
+// ExpandHome replaces a leading ~/ in path with the current user's home directory
+func ExpandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
@@ -0,0 +1,588 @@
+package sshconfig
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testServer is a minimal SSH server that accepts a single public key, answers "exec" requests
+// with the name of the server, and forwards direct-tcpip channels so it can serve as a jump host
+type testServer struct {
+	name    string
+	addr    string
+	hostKey ssh.Signer
+
+	mu    sync.Mutex
+	conns int
+}
+
+func newTestServer(t *testing.T, name string, userKey ssh.PublicKey) (*testServer, func()) {
+	t.Helper()
+
+	hostKey := newSigner(t)
+	s := &testServer{name: name, hostKey: hostKey}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if cert, ok := key.(*ssh.Certificate); ok {
+				key = cert.Key
+			}
+			if string(key.Marshal()) == string(userKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key")
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addr = l.Addr().String()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+
+	return s, func() { l.Close() }
+}
+
+func (s *testServer) serve(netConn net.Conn, config *ssh.ServerConfig) {
+	conn, chans, reqs, err := ssh.NewServerConn(netConn, config)
+	if err != nil {
+		netConn.Close()
+		return
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.conns++
+	s.mu.Unlock()
+
+	go ssh.DiscardRequests(reqs)
+
+	for newCh := range chans {
+		switch newCh.ChannelType() {
+		case "session":
+			ch, chReqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				for req := range chReqs {
+					if req.Type != "exec" {
+						req.Reply(false, nil)
+						continue
+					}
+					req.Reply(true, nil)
+					io.WriteString(ch, s.name)
+					ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+					ch.Close()
+				}
+			}()
+
+		case "direct-tcpip":
+			var target struct {
+				Host     string
+				Port     uint32
+				OrigHost string
+				OrigPort uint32
+			}
+			if err := ssh.Unmarshal(newCh.ExtraData(), &target); err != nil {
+				newCh.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			dst, err := net.Dial("tcp", net.JoinHostPort(target.Host, fmt.Sprint(target.Port)))
+			if err != nil {
+				newCh.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			ch, chReqs, err := newCh.Accept()
+			if err != nil {
+				dst.Close()
+				continue
+			}
+			go ssh.DiscardRequests(chReqs)
+			go func() {
+				io.Copy(ch, dst)
+				ch.Close()
+			}()
+			go func() {
+				io.Copy(dst, ch)
+				dst.Close()
+			}()
+
+		default:
+			newCh.Reject(ssh.UnknownChannelType, "unsupported")
+		}
+	}
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// writeKey writes a private key file and returns a Signer for the key. With a passphrase, an
+// encrypted PEM RSA key is written; otherwise an unencrypted OpenSSH ed25519 key.
+func writeKey(t *testing.T, path string, passphrase string) ssh.Signer {
+	t.Helper()
+
+	var key interface{}
+	var block *pem.Block
+	if passphrase == "" {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, block = priv, marshalOpenSSHKey(pub, priv)
+	} else {
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err = x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(priv), []byte(passphrase), x509.PEMCipherAES256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key = priv
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// marshalOpenSSHKey encodes an unencrypted ed25519 key in the openssh-key-v1 format
+func marshalOpenSSHKey(pub ed25519.PublicKey, priv ed25519.PrivateKey) *pem.Block {
+	sshPub, _ := ssh.NewPublicKey(pub)
+	pubBytes := sshPub.Marshal()
+
+	check := make([]byte, 4)
+	rand.Read(check)
+
+	privBlock := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+	}{
+		binary.BigEndian.Uint32(check),
+		binary.BigEndian.Uint32(check),
+		ssh.KeyAlgoED25519,
+		pub,
+		priv,
+		"",
+	})
+	for i := 1; len(privBlock)%8 != 0; i++ {
+		privBlock = append(privBlock, byte(i))
+	}
+
+	body := ssh.Marshal(struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{"none", "none", "", 1, pubBytes, privBlock})
+
+	return &pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: append([]byte("openssh-key-v1\x00"), body...),
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sshconfig-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "id_ed25519")
+	want := writeKey(t, path, "")
+
+	signer, err := LoadKey(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(signer.PublicKey().Marshal()) != string(want.PublicKey().Marshal()) {
+		t.Fatal("loaded the wrong key")
+	}
+
+	if _, err := LoadKey(filepath.Join(dir, "missing"), ""); err == nil {
+		t.Fatal("expected an error loading a missing key")
+	}
+}
+
+func TestLoadKeyEncrypted(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sshconfig-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "id_rsa")
+	want := writeKey(t, path, "s3cret")
+
+	if _, err := LoadKey(path, ""); err == nil || !strings.Contains(err.Error(), "no passphrase") {
+		t.Fatalf("expected a missing passphrase error, received %v", err)
+	}
+	if _, err := LoadKey(path, "wrong"); err == nil {
+		t.Fatal("expected an error with the wrong passphrase")
+	}
+
+	signer, err := LoadKey(path, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(signer.PublicKey().Marshal()) != string(want.PublicKey().Marshal()) {
+		t.Fatal("loaded the wrong key")
+	}
+}
+
+func TestLoadCertificate(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sshconfig-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyPath := filepath.Join(dir, "id_ed25519")
+	signer := writeKey(t, keyPath, "")
+	ca := newSigner(t)
+
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"etl"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	certSigner, err := LoadCertificate(signer, keyPath+"-cert.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := certSigner.PublicKey().(*ssh.Certificate); !ok {
+		t.Fatal("expected the signer to offer the certificate")
+	}
+
+	if _, err := LoadCertificate(newSigner(t), keyPath+"-cert.pub"); err != errCertMismatch {
+		t.Fatalf("expected %v, received %v", errCertMismatch, err)
+	}
+
+	// The certificate next to the key file is offered automatically
+	cfg := &Config{User: "etl", KeyFiles: []string{keyPath}, InsecureIgnoreHostKey: true}
+	methods, err := cfg.authMethods()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(methods) != 1 {
+		t.Fatalf("expected a single public key auth method, received %d", len(methods))
+	}
+}
+
+func TestKnownHosts(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sshconfig-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hostKey := newSigner(t).PublicKey()
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize("db1:22")}, hostKey)
+	if err := ioutil.WriteFile(knownHostsPath, []byte(line+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	callback, err := KnownHostsCallback(knownHostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}
+
+	if err := callback("db1:22", remote, hostKey); err != nil {
+		t.Errorf("expected the known key to be accepted: %s", err)
+	}
+	if err := callback("db1:22", remote, newSigner(t).PublicKey()); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("expected a mismatched key to be rejected, received %v", err)
+	}
+	err = callback("db2:22", remote, hostKey)
+	if err == nil || !strings.Contains(err.Error(), "not in known_hosts") {
+		t.Errorf("expected an unknown host to be rejected, received %v", err)
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) || len(keyErr.Want) != 0 {
+		t.Errorf("expected a *knownhosts.KeyError for an unknown host, received %v", err)
+	}
+
+	if algorithms := knownHostKeyAlgorithms(callback, "db1:22"); len(algorithms) != 1 || algorithms[0] != ssh.KeyAlgoED25519 {
+		t.Errorf("expected [%s], received %q", ssh.KeyAlgoED25519, algorithms)
+	}
+	if algorithms := knownHostKeyAlgorithms(callback, "db2:22"); algorithms != nil {
+		t.Errorf("expected no algorithms for an unknown host, received %q", algorithms)
+	}
+}
+
+func TestFingerprintCallback(t *testing.T) {
+	key := newSigner(t).PublicKey()
+	callback := FingerprintCallback(ssh.FingerprintSHA256(key))
+
+	if err := callback("db1:22", nil, key); err != nil {
+		t.Errorf("expected the key to be accepted: %s", err)
+	}
+	if err := callback("db1:22", nil, newSigner(t).PublicKey()); err == nil {
+		t.Error("expected a different key to be rejected")
+	}
+}
+
+func TestParseJumpSpec(t *testing.T) {
+	tests := []struct {
+		spec, user, addr string
+	}{
+		{"bastion", "", "bastion:22"},
+		{"ops@bastion", "ops", "bastion:22"},
+		{"ops@bastion:2222", "ops", "bastion:2222"},
+		{" [::1]:2222 ", "", "[::1]:2222"},
+		{"[::1]", "", "[::1]:22"},
+	}
+	for _, test := range tests {
+		user, addr, err := parseJumpSpec(test.spec)
+		if err != nil {
+			t.Errorf("%q: %s", test.spec, err)
+			continue
+		}
+		if user != test.user || addr != test.addr {
+			t.Errorf("%q: expected %q %q, received %q %q", test.spec, test.user, test.addr, user, addr)
+		}
+	}
+}
+
+func TestJumpDialer(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sshconfig-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyPath := filepath.Join(dir, "id_ed25519")
+	userKey := writeKey(t, keyPath, "")
+
+	var servers []*testServer
+	var lines []string
+	for _, name := range []string{"bastion1", "bastion2", "db"} {
+		s, stop := newTestServer(t, name, userKey.PublicKey())
+		defer stop()
+		servers = append(servers, s)
+		lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, s.hostKey.PublicKey()))
+	}
+
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	if err := ioutil.WriteFile(knownHostsPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{
+		User:            "etl",
+		KeyFiles:        []string{keyPath},
+		KnownHostsFiles: []string{knownHostsPath},
+		ProxyJump:       "ops@" + servers[0].addr + "," + servers[1].addr,
+	}
+
+	clientConfig, err := cfg.ClientConfig(servers[2].addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial, err := cfg.Dialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := dial("tcp", servers[2].addr, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := session.Output("hostname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "db" {
+		t.Fatalf("expected to reach db, reached %q", out)
+	}
+
+	for _, s := range servers {
+		s.mu.Lock()
+		if s.conns != 1 {
+			t.Errorf("expected one connection to %s, received %d", s.name, s.conns)
+		}
+		s.mu.Unlock()
+	}
+
+	// A host key that isn't in known_hosts is rejected at the first hop
+	cfg.KnownHostsFiles = []string{filepath.Join(dir, "empty")}
+	if err := ioutil.WriteFile(cfg.KnownHostsFiles[0], nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dial, err = cfg.Dialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err = cfg.ClientConfig(servers[2].addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dial("tcp", servers[2].addr, clientConfig); err == nil || !strings.Contains(err.Error(), "bastion") && !strings.Contains(err.Error(), servers[0].addr) {
+		t.Fatalf("expected the first jump host to be rejected, received %v", err)
+	}
+}
+
+func TestAgentConnection(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sshconfig-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, userKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: userKey}); err != nil {
+		t.Fatal(err)
+	}
+	signers, err := keyring.Signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Serve the keyring on a socket, counting the connections and noting when they are closed
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var agentConns int32
+	agentClosed := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&agentConns, 1)
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+				agentClosed <- struct{}{}
+			}()
+		}
+	}()
+
+	oldSock := os.Getenv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", sock)
+	defer os.Setenv("SSH_AUTH_SOCK", oldSock)
+
+	var servers []*testServer
+	for _, name := range []string{"bastion", "db"} {
+		s, stop := newTestServer(t, name, signers[0].PublicKey())
+		defer stop()
+		servers = append(servers, s)
+	}
+
+	cfg := &Config{
+		User:                  "etl",
+		Agent:                 true,
+		InsecureIgnoreHostKey: true,
+		ProxyJump:             servers[0].addr,
+	}
+	clientConfig, err := cfg.ClientConfig(servers[1].addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial, err := cfg.Dialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := dial("tcp", servers[1].addr, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	// The target and the jump host share one connection to the agent, closed by Close
+	if n := atomic.LoadInt32(&agentConns); n != 1 {
+		t.Errorf("expected one connection to ssh-agent, received %d", n)
+	}
+	if err := cfg.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-agentClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection to ssh-agent still open after Close")
+	}
+}
@@ -0,0 +1,273 @@
+package udt
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SyncAction is what SyncPrograms did with a program
+type SyncAction string
+
+const (
+	// SyncUnchanged is a program whose remote source already matches the local source
+	SyncUnchanged SyncAction = "unchanged"
+	// SyncCreated is a program that only existed locally and has been uploaded and compiled
+	SyncCreated SyncAction = "created"
+	// SyncUpdated is a program whose remote source differed and has been replaced and recompiled
+	SyncUpdated SyncAction = "updated"
+	// SyncDeleted is a program that only existed remotely and has been deleted
+	SyncDeleted SyncAction = "deleted"
+)
+
+// SyncOptions control SyncPrograms. The zero value uploads and compiles changed programs, replacing
+// the previous source without a backup.
+type SyncOptions struct {
+	// Extension, when set, limits the local sources to files with the extension, e.g. ".b". It is
+	// removed to give the program name.
+	Extension string
+
+	// Backup keeps the replaced source of updated programs, see BackupThenOverwrite
+	Backup       bool
+	BackupSuffix string
+
+	// Catalog enters compiled programs in the CatalogMode catalog
+	Catalog     bool
+	CatalogMode CatalogMode
+
+	// Delete deletes remote programs that don't exist locally, along with their catalog entries when
+	// Catalog is set. The agent programs of running batched queries are never deleted.
+	Delete bool
+}
+
+// SyncResult is the outcome of syncing one program
+type SyncResult struct {
+	Name   string
+	Action SyncAction
+
+	// Diagnostics are the warnings from compiling a created or updated program. When the compile
+	// fails they are in Err, a *CompileError.
+	Diagnostics []CompileDiagnostic
+
+	// Err is set when Action failed. The remote program is left as it was.
+	Err error
+}
+
+// SyncPrograms makes the BASIC programs in progFile match the sources in localDir. Sources are
+// compared by a SHA-256 hash of their encoded content, and only programs that are new or have
+// changed are uploaded and compiled. Hidden files and subdirectories of localDir are ignored, as
+// are object code, backups and temporary files in progFile.
+//
+// Programs are synced in name order and a failure doesn't stop the rest, so the results report
+// every program. The returned error is set when the programs couldn't be compared, or when any
+// program failed to sync.
+func (c *Client) SyncPrograms(localDir string, progFile string, opts SyncOptions) ([]SyncResult, error) {
+	return c.SyncProgramsContext(context.Background(), localDir, progFile, opts)
+}
+
+// SyncProgramsContext is like SyncPrograms but stops syncing if ctx is done first, returning the
+// results so far
+func (c *Client) SyncProgramsContext(ctx context.Context, localDir string, progFile string, opts SyncOptions) ([]SyncResult, error) {
+
+	if progFile == "" {
+		return nil, fmt.Errorf("progFile must not be blank")
+	}
+
+	local, err := c.localSources(localDir, opts.Extension)
+	if err != nil {
+		return nil, err
+	}
+
+	suffix := opts.BackupSuffix
+	if suffix == "" {
+		suffix = defaultBackupSuffix
+	}
+	remote, err := c.remoteSourceHashes(ctx, progFile, suffix)
+	if err != nil {
+		return nil, err
+	}
+
+	uploadOpts := UploadOptions{Overwrite: Overwrite}
+	if opts.Backup {
+		uploadOpts = UploadOptions{Overwrite: BackupThenOverwrite, BackupSuffix: opts.BackupSuffix}
+	}
+
+	var names []string
+	for name := range local {
+		names = append(names, name)
+	}
+	if opts.Delete {
+		for name := range remote {
+			if strings.HasPrefix(name, agentProgPrefix) {
+				continue
+			}
+			if _, ok := local[name]; !ok {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	// cataloged is filled in when the first program is deleted
+	var cataloged map[string]bool
+
+	var results []SyncResult
+	failed := 0
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+
+		src, isLocal := local[name]
+		remoteHash, isRemote := remote[name]
+
+		result := SyncResult{Name: name}
+		switch {
+		case !isLocal:
+			result.Action = SyncDeleted
+			if opts.Catalog && cataloged == nil {
+				if cataloged, err = c.catalogedPrograms(ctx, opts.CatalogMode); err != nil {
+					return results, err
+				}
+			}
+			if cataloged[name] {
+				result.Err = c.DeleteCatalogContext(ctx, name, opts.CatalogMode)
+			}
+			if result.Err == nil {
+				result.Err = c.DeleteBasicProgramContext(ctx, progFile, name)
+			}
+
+		case src.err != nil:
+			result.Action = SyncCreated
+			if isRemote {
+				result.Action = SyncUpdated
+			}
+			result.Err = src.err
+
+		case src.hash == remoteHash:
+			result.Action = SyncUnchanged
+
+		default:
+			result.Action = SyncCreated
+			if isRemote {
+				result.Action = SyncUpdated
+			}
+			result.Diagnostics, result.Err = c.CompileBasicProgramWithOptionsContext(ctx, progFile, name, src.text, uploadOpts)
+			if result.Err == nil && opts.Catalog {
+				result.Err = c.CatalogProgramContext(ctx, progFile, name, opts.CatalogMode)
+			}
+		}
+
+		if result.Err != nil {
+			failed++
+		}
+		results = append(results, result)
+	}
+
+	if failed > 0 {
+		return results, fmt.Errorf("failed to sync %d of %d BASIC programs to %s", failed, len(results), progFile)
+	}
+	return results, nil
+}
+
+// localSource is a program source read from the local directory
+type localSource struct {
+	text string
+	hash string
+	err  error // set when the source couldn't be read or encoded
+}
+
+// localSources reads the program sources in dir, keyed by program name. The hashes are of the
+// source as it would be uploaded.
+func (c *Client) localSources(dir string, ext string) (map[string]localSource, error) {
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list local BASIC sources: %w", err)
+	}
+
+	sources := make(map[string]localSource)
+	for _, fi := range files {
+		name := fi.Name()
+		if !fi.Mode().IsRegular() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		progName := strings.TrimSuffix(name, ext)
+		if progName == "" {
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			sources[progName] = localSource{err: fmt.Errorf("failed to read BASIC source: %w", err)}
+			continue
+		}
+		encoded, err := c.encodeString(string(buf))
+		if err != nil {
+			sources[progName] = localSource{err: fmt.Errorf("failed to encode BASIC source: %w", err)}
+			continue
+		}
+		sum := sha256.Sum256([]byte(encoded))
+		sources[progName] = localSource{text: string(buf), hash: hex.EncodeToString(sum[:])}
+	}
+	return sources, nil
+}
+
+// remoteSourceHashes returns the SHA-256 hash of each program source in progFile, keyed by program
+// name. Object code, backups ending in backupSuffix and the temporary files of an upload are
+// skipped.
+func (c *Client) remoteSourceHashes(ctx context.Context, progFile string, backupSuffix string) (map[string]string, error) {
+
+	dir := c.env.UdtAcct + "/" + progFile
+	fi, err := c.transport.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find program file (%s): %w", dir, err)
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("program file %s is not a directory-type file", progFile)
+	}
+
+	out, err := c.shellOutput(ctx, fmt.Sprintf(`cd %s || exit 1
+if command -v sha256sum >/dev/null 2>&1; then hash() { sha256sum; }; else hash() { openssl dgst -sha256 -r; }; fi
+for f in *; do
+	case "$f" in _*) continue ;; esac
+	[ -f "$f" ] && printf '%%s %%s\n' "$(hash < "$f" | cut -d' ' -f1)" "$f"
+done; true`, shellQuote(dir)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash remote BASIC sources: %w", err)
+	}
+
+	hashes := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		name := fields[1]
+		if strings.HasSuffix(name, backupSuffix) || strings.HasSuffix(name, ".tmp") || strings.HasSuffix(name, ".orig") {
+			continue
+		}
+		hashes[name] = fields[0]
+	}
+	return hashes, nil
+}
+
+// catalogedPrograms returns the names of the programs in the mode's catalog
+func (c *Client) catalogedPrograms(ctx context.Context, mode CatalogMode) (map[string]bool, error) {
+	entries, err := c.ListCatalogContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, e := range entries {
+		if e.Mode == mode {
+			names[e.Name] = true
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,203 @@
+package udt
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// syncActions returns the action taken for each program, or "failed" when it failed
+func syncActions(results []SyncResult) map[string]string {
+	actions := make(map[string]string)
+	for _, r := range results {
+		actions[r.Name] = string(r.Action)
+		if r.Err != nil {
+			actions[r.Name] = "failed"
+		}
+	}
+	return actions
+}
+
+func TestSyncPrograms(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "udt-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeSource := func(name, src string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeSource("KEEP.b", "RETURN\n")
+	writeSource("CHANGE.b", "X = 1\nRETURN\n")
+	writeSource("REMOVE.b", "RETURN\n")
+	writeSource("notes.txt", "not a program")
+
+	opts := SyncOptions{Extension: ".b", Delete: true}
+
+	results, err := c.SyncPrograms(dir, "BP", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"CHANGE": "created", "KEEP": "created", "REMOVE": "created"}
+	if actions := syncActions(results); !reflect.DeepEqual(actions, expected) {
+		t.Errorf("expected %v, received %v", expected, actions)
+	}
+
+	// A program not in the local directory is deleted, object code and all
+	if err := c.CompileBasicProgram("BP", "STALE", "RETURN"); err != nil {
+		t.Fatal(err)
+	}
+	writeSource("CHANGE.b", "X = 2\nY = UNUSED\nRETURN\n")
+	writeSource("BROKEN.b", "SYNTAX\n")
+
+	// Source that was never compiled is deleted too, but the agent program of a running batched
+	// query is left alone
+	for _, name := range []string{"ORPHAN", agentProgPrefix + "1234", "_" + agentProgPrefix + "1234"} {
+		if err := ioutil.WriteFile(env.UdtAcct+"/BP/"+name, []byte("RETURN\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(filepath.Join(dir, "REMOVE.b")); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err = c.SyncPrograms(dir, "BP", opts)
+	if err == nil {
+		t.Error("expected an error when a program fails to compile")
+	}
+	expected = map[string]string{"BROKEN": "failed", "CHANGE": "updated", "KEEP": "unchanged", "ORPHAN": "deleted", "REMOVE": "deleted", "STALE": "deleted"}
+	if actions := syncActions(results); !reflect.DeepEqual(actions, expected) {
+		t.Errorf("expected %v, received %v", expected, actions)
+	}
+	for _, r := range results {
+		switch r.Name {
+		case "BROKEN":
+			var compileErr *CompileError
+			if !errors.As(r.Err, &compileErr) {
+				t.Errorf("expected a *CompileError, received %v", r.Err)
+			}
+		case "CHANGE":
+			if len(r.Diagnostics) != 1 || r.Diagnostics[0].Severity != SeverityWarning {
+				t.Errorf("expected a warning, received %+v", r.Diagnostics)
+			}
+		}
+	}
+
+	files, err := ioutil.ReadDir(env.UdtAcct + "/BP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	expectedNames := []string{"CHANGE", agentProgPrefix + "1234", "KEEP", "_CHANGE", "_" + agentProgPrefix + "1234", "_KEEP"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("expected %v, received %v", expectedNames, names)
+	}
+
+	// Nothing left to do once the broken program is fixed and synced
+	writeSource("BROKEN.b", "RETURN\n")
+	if _, err := c.SyncPrograms(dir, "BP", opts); err != nil {
+		t.Fatal(err)
+	}
+	results, err = c.SyncPrograms(dir, "BP", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]string{"BROKEN": "unchanged", "CHANGE": "unchanged", "KEEP": "unchanged"}
+	if actions := syncActions(results); !reflect.DeepEqual(actions, expected) {
+		t.Errorf("expected %v, received %v", expected, actions)
+	}
+	assertDirEmpty(t, env.UdtAcct+"/_PH_")
+}
+
+func TestSyncProgramsCatalog(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "udt-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"SUB.A", "SUB.B"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("RETURN\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := SyncOptions{Backup: true, Catalog: true, CatalogMode: CatalogDirect, Delete: true}
+	if _, err := c.SyncPrograms(dir, "BP", opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "SUB.A"), []byte("X = 1\nRETURN\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "SUB.B")); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := c.SyncPrograms(dir, "BP", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"SUB.A": "updated", "SUB.B": "deleted"}
+	if actions := syncActions(results); !reflect.DeepEqual(actions, expected) {
+		t.Errorf("expected %v, received %v", expected, actions)
+	}
+
+	entries, err := c.ListCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedEntries := []CatalogEntry{{Name: "SUB.A", Mode: CatalogDirect, Path: "BP/_SUB.A"}}
+	if !reflect.DeepEqual(entries, expectedEntries) {
+		t.Errorf("expected %+v, received %+v", expectedEntries, entries)
+	}
+
+	// The backup of the replaced source isn't mistaken for a program
+	if _, err := os.Stat(env.UdtAcct + "/BP/SUB.A.bak"); err != nil {
+		t.Error(err)
+	}
+	results, err = c.SyncPrograms(dir, "BP", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]string{"SUB.A": "unchanged"}
+	if actions := syncActions(results); !reflect.DeepEqual(actions, expected) {
+		t.Errorf("expected %v, received %v", expected, actions)
+	}
+}
+
+func TestSyncProgramsMissingFile(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "udt-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := c.SyncPrograms(dir, "NOSUCHFILE", SyncOptions{}); err == nil {
+		t.Error("expected an error syncing to a program file that doesn't exist")
+	}
+	if _, err := c.SyncPrograms(filepath.Join(dir, "missing"), "BP", SyncOptions{}); err == nil {
+		t.Error("expected an error syncing from a directory that doesn't exist")
+	}
+}
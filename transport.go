@@ -0,0 +1,82 @@
+package udt
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Transport provides access to the host running the Unidata database. Shell commands are run with
+// a POSIX shell and paths are interpreted on the database host.
+type Transport interface {
+	// Command prepares shellCmd to be run by the host's shell
+	Command(shellCmd string) (Cmd, error)
+
+	// Open opens the named file for reading
+	Open(path string) (io.ReadCloser, error)
+
+	// Create creates or truncates the named file for writing
+	Create(path string) (io.WriteCloser, error)
+
+	// Remove removes the named file
+	Remove(path string) error
+
+	// Rename renames a file, replacing newpath if it exists
+	Rename(oldpath, newpath string) error
+
+	// Stat returns information about the named file
+	Stat(path string) (os.FileInfo, error)
+
+	// Close releases any resources held by the Transport
+	Close() error
+}
+
+// Cmd is a shell command prepared by a Transport. Pipes must be requested before calling Start and
+// should be read concurrently with Wait; a command may block until its output has been consumed.
+type Cmd interface {
+	StdinPipe() (io.WriteCloser, error)
+	StdoutPipe() (io.Reader, error)
+	StderrPipe() (io.Reader, error)
+
+	// Start starts the command but does not wait for it to complete
+	Start() error
+
+	// Wait waits for the command to exit
+	Wait() error
+
+	// Kill forcibly terminates the command
+	Kill() error
+
+	// Close releases any resources associated with the command, terminating it if it is still running
+	Close() error
+}
+
+// PTYCmd is implemented by Cmds that can run on a pseudo-terminal
+type PTYCmd interface {
+	// RequestPTY asks for the command to be run on a pseudo-terminal of the given type and size,
+	// with input echo disabled. It must be called before Start.
+	RequestPTY(term string, height, width int) error
+}
+
+var errTransportClosed = errors.New("transport has been closed")
+
+// errPTYUnsupported is returned when requesting a pseudo-terminal from a Cmd that isn't a PTYCmd
+var errPTYUnsupported = errors.New("transport does not support pseudo-terminals")
+
+// exitStatus extracts the exit status of a command from the error returned by Cmd.Wait. As with
+// os/exec, a command terminated by a signal has a status of -1.
+func exitStatus(err error) (int, bool) {
+	switch err := err.(type) {
+	case *ssh.ExitError:
+		if err.Signal() != "" {
+			return -1, true
+		}
+		return err.ExitStatus(), true
+	case *exec.ExitError:
+		return err.ExitCode(), true
+	}
+	return 0, false
+}
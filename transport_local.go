@@ -0,0 +1,164 @@
+package udt
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// NewLocalTransport returns a Transport that runs commands with the local /bin/sh and accesses
+// files on the local filesystem. It is intended for use on the database host itself.
+func NewLocalTransport() Transport {
+	return &localTransport{}
+}
+
+type localTransport struct{}
+
+// Command implements the Transport interface
+func (t *localTransport) Command(shellCmd string) (Cmd, error) {
+	return &localCmd{
+		cmd: exec.Command("/bin/sh", "-c", shellCmd),
+	}, nil
+}
+
+// Open implements the Transport interface
+func (t *localTransport) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+// Create implements the Transport interface
+func (t *localTransport) Create(path string) (io.WriteCloser, error) {
+	return os.Create(path)
+}
+
+// Remove implements the Transport interface
+func (t *localTransport) Remove(path string) error {
+	return os.Remove(path)
+}
+
+// Rename implements the Transport interface
+func (t *localTransport) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// Stat implements the Transport interface
+func (t *localTransport) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+// Close implements the Transport interface
+func (t *localTransport) Close() error {
+	return nil
+}
+
+type localCmd struct {
+	cmd *exec.Cmd
+
+	// Input and output are passed through os.Pipes rather than the pipes provided by exec.Cmd so
+	// output can still be read after Wait returns, matching the behaviour of an SSH session. The
+	// child's ends of the pipes are closed once it has started.
+	childEnds  []*os.File
+	parentEnds []*os.File
+
+	mu       sync.Mutex
+	started  bool
+	waitOnce sync.Once
+	waitErr  error
+}
+
+// outputPipe returns a pipe for the child's output, the child writes to w and we read from r
+func (c *localCmd) outputPipe() (r *os.File, w *os.File, err error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	c.childEnds = append(c.childEnds, pw)
+	c.parentEnds = append(c.parentEnds, pr)
+	return pr, pw, nil
+}
+
+func (c *localCmd) StdinPipe() (io.WriteCloser, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	c.childEnds = append(c.childEnds, pr)
+	c.parentEnds = append(c.parentEnds, pw)
+	c.cmd.Stdin = pr
+	return pw, nil
+}
+
+func (c *localCmd) StdoutPipe() (io.Reader, error) {
+	pr, pw, err := c.outputPipe()
+	if err != nil {
+		return nil, err
+	}
+	c.cmd.Stdout = pw
+	return pr, nil
+}
+
+func (c *localCmd) StderrPipe() (io.Reader, error) {
+	pr, pw, err := c.outputPipe()
+	if err != nil {
+		return nil, err
+	}
+	c.cmd.Stderr = pw
+	return pr, nil
+}
+
+func (c *localCmd) Start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.cmd.Start()
+
+	// The child has its own copies of its ends, closing ours means readers see EOF once the
+	// child's output is closed and writers see EPIPE once the child's input is closed
+	for _, f := range c.childEnds {
+		_ = f.Close()
+	}
+
+	if err != nil {
+		return err
+	}
+	c.started = true
+	return nil
+}
+
+func (c *localCmd) Wait() error {
+	c.waitOnce.Do(func() {
+		c.waitErr = c.cmd.Wait()
+	})
+	return c.waitErr
+}
+
+func (c *localCmd) Kill() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.started {
+		return nil
+	}
+	return c.cmd.Process.Kill()
+}
+
+func (c *localCmd) Close() error {
+	c.mu.Lock()
+	started := c.started
+	c.mu.Unlock()
+
+	for _, f := range c.parentEnds {
+		_ = f.Close()
+	}
+	if !started {
+		for _, f := range c.childEnds {
+			_ = f.Close()
+		}
+		return nil
+	}
+
+	_ = c.Kill()
+	_ = c.Wait()
+	return nil
+}
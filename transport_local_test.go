@@ -0,0 +1,159 @@
+package udt
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalTransportCommand(t *testing.T) {
+
+	tr := NewLocalTransport()
+	defer tr.Close()
+
+	cmd, err := tr.Command(`cat; echo "to stderr" >&2; exit 3`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Close()
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.WriteString(stdin, "to stdout\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Like an SSH session, the output can still be read once the command has been waited on
+	err = cmd.Wait()
+	if status, ok := exitStatus(err); !ok || status != 3 {
+		t.Errorf("expected exit status 3, received %v", err)
+	}
+	if out, err := ioutil.ReadAll(stdout); err != nil || string(out) != "to stdout\n" {
+		t.Errorf("unexpected stdout: %q, %v", out, err)
+	}
+	if out, err := ioutil.ReadAll(stderr); err != nil || string(out) != "to stderr\n" {
+		t.Errorf("unexpected stderr: %q, %v", out, err)
+	}
+}
+
+func TestLocalTransportKill(t *testing.T) {
+
+	tr := NewLocalTransport()
+	defer tr.Close()
+
+	cmd, err := tr.Command("sleep 30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Close()
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := cmd.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err == nil {
+		t.Error("expected an error waiting on a killed command")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s to kill", elapsed)
+	}
+}
+
+func TestLocalTransportFiles(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "udt-transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tr := NewLocalTransport()
+	defer tr.Close()
+
+	path := filepath.Join(dir, "file.tmp")
+	w, err := tr.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "contents"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	renamed := filepath.Join(dir, "file")
+	if err := tr.Rename(path, renamed); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := tr.Stat(renamed); err != nil || fi.Size() != int64(len("contents")) {
+		t.Fatalf("unexpected result: %v, %v", fi, err)
+	}
+
+	r, err := tr.Open(renamed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(buf) != "contents" {
+		t.Fatalf("unexpected result: %q, %v", buf, err)
+	}
+
+	if err := tr.Remove(renamed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.Stat(renamed); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected %v, received %v", os.ErrNotExist, err)
+	}
+}
+
+func TestLocalTransportClient(t *testing.T) {
+
+	c, env, cleanup := newTestClient(t)
+	defer cleanup()
+
+	// The client's operations work unchanged on the database host itself
+	if err := c.CompileBasicProgram("BP", "LOCAL", "RETURN\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(env.UdtAcct + "/BP/_LOCAL"); err != nil {
+		t.Error(err)
+	}
+
+	r, err := c.ExecutePhantom("HELLO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(out) != "HELLO\n" {
+		t.Fatalf("unexpected result: %q, %v", out, err)
+	}
+	assertDirEmpty(t, env.UdtAcct+"/_PH_")
+}
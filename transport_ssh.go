@@ -0,0 +1,593 @@
+package udt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHDialConfig configures a Transport that dials and maintains its own SSH connection
+type SSHDialConfig struct {
+	// Addr is the host:port of the SSH server
+	Addr string
+
+	// ClientConfig is used to authenticate each connection
+	ClientConfig *ssh.ClientConfig
+
+	// Dial establishes each connection, it defaults to ssh.Dial. See the sshconfig package for a
+	// dialer that connects through jump hosts.
+	Dial func(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error)
+
+	// KeepaliveInterval is how often keepalive requests are sent. A connection that fails to answer
+	// a keepalive within KeepaliveTimeout is considered lost. A negative interval disables keepalives.
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+
+	// MinBackoff and MaxBackoff bound the delay between redial attempts, the delay doubles after
+	// each failed attempt. MaxRedials is the number of attempts made before giving up.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	MaxRedials int
+
+	// Closer, when set, is closed along with the Transport. It is for resources that redials depend
+	// on, such as the ssh-agent connection of an sshconfig.Config.
+	Closer io.Closer
+}
+
+const (
+	defaultKeepaliveInterval = 30 * time.Second
+	defaultKeepaliveTimeout  = 15 * time.Second
+	defaultMinBackoff        = 500 * time.Millisecond
+	defaultMaxBackoff        = 30 * time.Second
+	defaultMaxRedials        = 5
+)
+
+// DialSSHTransport dials the configured SSH server and returns a Transport that owns the
+// connection. Keepalive requests are sent to detect dead connections, and a lost connection is
+// redialed before the next command or file operation. Operations that were in flight when the
+// connection was lost fail with a *ConnectionLostError. Closing the Transport closes the connection.
+func DialSSHTransport(config *SSHDialConfig) (Transport, error) {
+
+	cfg := *config
+	if cfg.KeepaliveInterval == 0 {
+		cfg.KeepaliveInterval = defaultKeepaliveInterval
+	}
+	if cfg.KeepaliveTimeout <= 0 {
+		cfg.KeepaliveTimeout = defaultKeepaliveTimeout
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = defaultMinBackoff
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = defaultMaxBackoff
+	}
+	if cfg.MaxRedials <= 0 {
+		cfg.MaxRedials = defaultMaxRedials
+	}
+	if cfg.Dial == nil {
+		cfg.Dial = ssh.Dial
+	}
+
+	t := &sshTransport{
+		dialCfg: &cfg,
+		done:    make(chan struct{}),
+	}
+
+	conn, err := t.dial()
+	if err != nil {
+		return nil, err
+	}
+	t.conn = conn
+
+	return t, nil
+}
+
+// NewSSHTransport returns a Transport that runs commands in SSH sessions on the provided client and
+// accesses files using the SFTP subsystem. A single SFTP session is opened on first use and shared
+// by all file operations until the Transport is closed. Closing the Transport does not close the
+// SSH client, and a lost connection is not redialed; use DialSSHTransport for that.
+func NewSSHTransport(client *ssh.Client) Transport {
+	return &sshTransport{
+		conn: newSSHConn(client),
+		done: make(chan struct{}),
+	}
+}
+
+type sshTransport struct {
+	// dialCfg is nil when the SSH client was provided by the caller
+	dialCfg *SSHDialConfig
+
+	mu     sync.Mutex
+	conn   *sshConn
+	closed bool
+	redial *redialCall // the redial in progress, if any
+
+	// done is closed when the Transport is closed, interrupting a redial
+	done chan struct{}
+
+	sftpMu     sync.Mutex
+	sftpClient *sftp.Client
+}
+
+// sshConn tracks the lifetime of a single SSH connection
+type sshConn struct {
+	client *ssh.Client
+	lost   chan struct{}
+	err    error
+}
+
+func newSSHConn(client *ssh.Client) *sshConn {
+	c := &sshConn{
+		client: client,
+		lost:   make(chan struct{}),
+	}
+	go func() {
+		c.err = client.Wait()
+		close(c.lost)
+	}()
+	return c
+}
+
+func (c *sshConn) isLost() bool {
+	select {
+	case <-c.lost:
+		return true
+	default:
+		return false
+	}
+}
+
+// lostGracePeriod is how long to wait for a connection to be noticed closed after an operation fails
+// in a way that suggests it was lost
+const lostGracePeriod = 100 * time.Millisecond
+
+// lostErr translates err into a *ConnectionLostError if the connection has been lost. An operation
+// can observe a failure slightly before the connection is noticed to be closed, so when err looks
+// like a dropped connection we allow a short grace period for that to happen.
+func (c *sshConn) lostErr(err error) error {
+	if c.isLost() {
+		return &ConnectionLostError{Err: err}
+	}
+	if !suspectLost(err) {
+		return err
+	}
+	select {
+	case <-c.lost:
+		return &ConnectionLostError{Err: err}
+	case <-time.After(lostGracePeriod):
+		return err
+	}
+}
+
+// suspectLost reports whether err is the kind of failure an operation sees when its connection drops
+func suspectLost(err error) bool {
+	var exitMissing *ssh.ExitMissingError
+	var netErr net.Error
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, sftp.ErrSSHFxConnectionLost) ||
+		errors.As(err, &exitMissing) ||
+		errors.As(err, &netErr)
+}
+
+// keepalive periodically sends a keepalive request, closing the connection if one goes unanswered
+func (c *sshConn) keepalive(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.lost:
+			return
+		case <-ticker.C:
+		}
+
+		errc := make(chan error, 1)
+		go func() {
+			// Servers reply with a failure to requests they don't understand, which is fine; any
+			// reply at all shows the connection is alive
+			_, _, err := c.client.SendRequest("keepalive@openssh.com", true, nil)
+			errc <- err
+		}()
+
+		select {
+		case <-c.lost:
+			return
+		case err := <-errc:
+			if err != nil {
+				_ = c.client.Close()
+				return
+			}
+		case <-time.After(timeout):
+			_ = c.client.Close()
+			return
+		}
+	}
+}
+
+// dial connects to the configured server, retrying with exponential backoff. It gives up with
+// errTransportClosed if the Transport is closed while waiting to retry.
+func (t *sshTransport) dial() (*sshConn, error) {
+	cfg := t.dialCfg
+	backoff := cfg.MinBackoff
+
+	var err error
+	for attempt := 0; attempt < cfg.MaxRedials; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-t.done:
+				timer.Stop()
+				return nil, errTransportClosed
+			case <-timer.C:
+			}
+			if backoff *= 2; backoff > cfg.MaxBackoff {
+				backoff = cfg.MaxBackoff
+			}
+		}
+
+		var client *ssh.Client
+		if client, err = cfg.Dial("tcp", cfg.Addr, cfg.ClientConfig); err == nil {
+			conn := newSSHConn(client)
+			if cfg.KeepaliveInterval > 0 {
+				go conn.keepalive(cfg.KeepaliveInterval, cfg.KeepaliveTimeout)
+			}
+			return conn, nil
+		}
+	}
+
+	return nil, fmt.Errorf("failed to connect to SSH server (%s) after %d attempts: %s", cfg.Addr, cfg.MaxRedials, err)
+}
+
+// redialCall is a redial shared by every operation that finds the connection lost while it is in
+// progress
+type redialCall struct {
+	done chan struct{}
+	conn *sshConn
+	err  error
+}
+
+// current returns the current connection, redialing first if it has been lost. The redial happens
+// without holding the lock, so Close can interrupt it.
+func (t *sshTransport) current() (*sshConn, error) {
+	t.mu.Lock()
+
+	if t.closed {
+		t.mu.Unlock()
+		return nil, errTransportClosed
+	}
+	if !t.conn.isLost() {
+		conn := t.conn
+		t.mu.Unlock()
+		return conn, nil
+	}
+	if t.dialCfg == nil {
+		err := t.conn.err
+		t.mu.Unlock()
+		return nil, &ConnectionLostError{Err: err}
+	}
+
+	call := t.redial
+	if call == nil {
+		call = &redialCall{done: make(chan struct{})}
+		t.redial = call
+		go t.runRedial(call)
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.conn, call.err
+	case <-t.done:
+		return nil, errTransportClosed
+	}
+}
+
+// runRedial dials a new connection to replace the lost one
+func (t *sshTransport) runRedial(call *redialCall) {
+	conn, err := t.dial()
+
+	t.mu.Lock()
+	t.redial = nil
+	switch {
+	case err == errTransportClosed:
+	case err != nil:
+		err = &ConnectionLostError{Err: err}
+	case t.closed:
+		_ = conn.client.Close()
+		conn, err = nil, errTransportClosed
+	default:
+		t.conn = conn
+	}
+	t.mu.Unlock()
+
+	call.conn, call.err = conn, err
+	close(call.done)
+}
+
+// sftp returns the shared SFTP client, opening a new one if there isn't one yet or the previous one
+// has shut down
+func (t *sshTransport) sftp() (*sftp.Client, *sshConn, error) {
+	conn, err := t.current()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t.sftpMu.Lock()
+	defer t.sftpMu.Unlock()
+
+	if t.sftpClient != nil {
+		return t.sftpClient, conn, nil
+	}
+
+	client, err := sftp.NewClient(conn.client)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize SFTP client: %s", err)
+	}
+	t.sftpClient = client
+
+	// Forget the client once its connection shuts down so the next operation opens a new one
+	go func() {
+		_ = client.Wait()
+		t.forgetSFTP(client)
+	}()
+
+	return client, conn, nil
+}
+
+func (t *sshTransport) forgetSFTP(client *sftp.Client) {
+	t.sftpMu.Lock()
+	defer t.sftpMu.Unlock()
+
+	if t.sftpClient == client {
+		t.sftpClient = nil
+	}
+}
+
+// withSFTP calls fn with the shared SFTP client. If the SFTP connection is lost during the call it
+// is retried once on a new connection.
+func (t *sshTransport) withSFTP(fn func(*sftp.Client, *sshConn) error) error {
+	client, conn, err := t.sftp()
+	if err != nil {
+		return err
+	}
+
+	err = fn(client, conn)
+	if err != sftp.ErrSSHFxConnectionLost && err != io.EOF {
+		return err
+	}
+
+	t.forgetSFTP(client)
+	_ = client.Close()
+
+	if client, conn, err = t.sftp(); err != nil {
+		return err
+	}
+	if err = fn(client, conn); err == sftp.ErrSSHFxConnectionLost || err == io.EOF {
+		return conn.lostErr(err)
+	}
+	return err
+}
+
+// Command implements the Transport interface
+func (t *sshTransport) Command(shellCmd string) (Cmd, error) {
+	conn, err := t.current()
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := conn.client.NewSession()
+	if err != nil {
+		if _, lost := conn.lostErr(err).(*ConnectionLostError); lost {
+			// The connection died since we last checked, try again on a fresh one
+			if conn, err = t.current(); err != nil {
+				return nil, err
+			}
+			session, err = conn.client.NewSession()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SSH session: %w", conn.lostErr(err))
+	}
+
+	return &sshCmd{
+		conn:     conn,
+		session:  session,
+		shellCmd: shellCmd,
+	}, nil
+}
+
+// Open implements the Transport interface
+func (t *sshTransport) Open(path string) (io.ReadCloser, error) {
+	var f *sshFile
+	err := t.withSFTP(func(client *sftp.Client, conn *sshConn) error {
+		sf, err := client.Open(path)
+		if err != nil {
+			return err
+		}
+		f = &sshFile{sf, conn}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Create implements the Transport interface
+func (t *sshTransport) Create(path string) (io.WriteCloser, error) {
+	var f *sshFile
+	err := t.withSFTP(func(client *sftp.Client, conn *sshConn) error {
+		sf, err := client.Create(path)
+		if err != nil {
+			return err
+		}
+		f = &sshFile{sf, conn}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Remove implements the Transport interface
+func (t *sshTransport) Remove(path string) error {
+	return t.withSFTP(func(client *sftp.Client, _ *sshConn) error {
+		return client.Remove(path)
+	})
+}
+
+// Rename implements the Transport interface. It relies on the posix-rename SFTP extension supported
+// by OpenSSH, as a plain SFTP rename fails if newpath exists.
+func (t *sshTransport) Rename(oldpath, newpath string) error {
+	return t.withSFTP(func(client *sftp.Client, _ *sshConn) error {
+		return client.PosixRename(oldpath, newpath)
+	})
+}
+
+// Stat implements the Transport interface
+func (t *sshTransport) Stat(path string) (os.FileInfo, error) {
+	var fi os.FileInfo
+	err := t.withSFTP(func(client *sftp.Client, _ *sshConn) error {
+		var err error
+		fi, err = client.Stat(path)
+		return err
+	})
+	return fi, err
+}
+
+// Close implements the Transport interface. It closes the shared SFTP session, and the SSH
+// connection if it was dialed by the Transport.
+func (t *sshTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	close(t.done)
+
+	var err error
+
+	t.sftpMu.Lock()
+	if t.sftpClient != nil {
+		if cerr := t.sftpClient.Close(); cerr != nil {
+			err = fmt.Errorf("failed to close SFTP client: %s", cerr)
+		}
+		t.sftpClient = nil
+	}
+	t.sftpMu.Unlock()
+
+	if t.dialCfg != nil && !t.conn.isLost() {
+		if cerr := t.conn.client.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("failed to close SSH connection: %s", cerr)
+		}
+	}
+
+	if t.dialCfg != nil && t.dialCfg.Closer != nil {
+		if cerr := t.dialCfg.Closer.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// sshFile is a file opened over SFTP whose errors are reported as a *ConnectionLostError if the
+// SSH connection is lost
+type sshFile struct {
+	f    *sftp.File
+	conn *sshConn
+}
+
+func (f *sshFile) Read(p []byte) (int, error) {
+	n, err := f.f.Read(p)
+	if err != nil && err != io.EOF {
+		err = f.conn.lostErr(err)
+	}
+	return n, err
+}
+
+func (f *sshFile) Write(p []byte) (int, error) {
+	n, err := f.f.Write(p)
+	if err != nil {
+		err = f.conn.lostErr(err)
+	}
+	return n, err
+}
+
+func (f *sshFile) Close() error {
+	return f.f.Close()
+}
+
+type sshCmd struct {
+	conn     *sshConn
+	session  *ssh.Session
+	shellCmd string
+}
+
+func (c *sshCmd) StdinPipe() (io.WriteCloser, error) {
+	return c.session.StdinPipe()
+}
+
+func (c *sshCmd) StdoutPipe() (io.Reader, error) {
+	return c.session.StdoutPipe()
+}
+
+func (c *sshCmd) StderrPipe() (io.Reader, error) {
+	return c.session.StderrPipe()
+}
+
+// RequestPTY implements the PTYCmd interface
+func (c *sshCmd) RequestPTY(term string, height, width int) error {
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          0,
+		ssh.TTY_OP_ISPEED: 38400,
+		ssh.TTY_OP_OSPEED: 38400,
+	}
+	if err := c.session.RequestPty(term, height, width, modes); err != nil {
+		return c.conn.lostErr(err)
+	}
+	return nil
+}
+
+func (c *sshCmd) Start() error {
+	if err := c.session.Start(c.shellCmd); err != nil {
+		return c.conn.lostErr(err)
+	}
+	return nil
+}
+
+func (c *sshCmd) Wait() error {
+	err := c.session.Wait()
+	if _, ok := err.(*ssh.ExitError); err != nil && !ok {
+		return c.conn.lostErr(err)
+	}
+	return err
+}
+
+// Kill signals the remote process to terminate and closes the session. Not every SSH server
+// honours signal requests, closing the session ensures we stop waiting on it regardless.
+func (c *sshCmd) Kill() error {
+	_ = c.session.Signal(ssh.SIGKILL)
+	return c.session.Close()
+}
+
+func (c *sshCmd) Close() error {
+	// https://stackoverflow.com/questions/42590308/proper-way-to-close-a-crypto-ssh-session-freeing-all-resources-in-golang#comment72394178_42590388
+	// session.Close() will return io.EOF if called after session.Wait()/session.Run()
+	// we want to ignore the EOF
+	if err := c.session.Close(); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
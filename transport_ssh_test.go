@@ -0,0 +1,461 @@
+package udt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHServer is an in-process SSH server. Commands echo themselves, except "hang" which runs
+// until the connection is dropped and "killed" which is terminated by SIGKILL, and the sftp
+// subsystem serves the local filesystem.
+type testSSHServer struct {
+	ln      net.Listener
+	config  *ssh.ServerConfig
+	hostKey ssh.PublicKey
+
+	// ignoreKeepalives makes the server leave global requests unanswered when set to 1
+	ignoreKeepalives int32
+
+	mu    sync.Mutex
+	conns []net.Conn
+	dials int
+}
+
+func newTestSSHServer(t *testing.T) *testSSHServer {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testSSHServer{
+		ln:      ln,
+		config:  &ssh.ServerConfig{NoClientAuth: true},
+		hostKey: signer.PublicKey(),
+	}
+	s.config.AddHostKey(signer)
+
+	go s.serve()
+	return s
+}
+
+// dialConfig returns a config for dialing the server that redials quickly
+func (s *testSSHServer) dialConfig() *SSHDialConfig {
+	return &SSHDialConfig{
+		Addr: s.ln.Addr().String(),
+		ClientConfig: &ssh.ClientConfig{
+			User:            "test",
+			HostKeyCallback: ssh.FixedHostKey(s.hostKey),
+		},
+		KeepaliveInterval: -1,
+		MinBackoff:        10 * time.Millisecond,
+		MaxBackoff:        10 * time.Millisecond,
+	}
+}
+
+func (s *testSSHServer) serve() {
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, nc)
+		s.dials++
+		s.mu.Unlock()
+		go s.handle(nc)
+	}
+}
+
+func (s *testSSHServer) handle(nc net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(nc, s.config)
+	if err != nil {
+		nc.Close()
+		return
+	}
+
+	go func() {
+		for req := range reqs {
+			if atomic.LoadInt32(&s.ignoreKeepalives) == 0 && req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}()
+
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			_ = nch.Reject(ssh.UnknownChannelType, nch.ChannelType())
+			continue
+		}
+		ch, chReqs, err := nch.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(ch, chReqs)
+	}
+}
+
+func (s *testSSHServer) session(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	for req := range reqs {
+		var payload struct{ Value string }
+		switch req.Type {
+		case "exec":
+			_ = ssh.Unmarshal(req.Payload, &payload)
+			_ = req.Reply(true, nil)
+			if payload.Value == "hang" {
+				for range reqs {
+				}
+				return
+			}
+			if payload.Value == "killed" {
+				_, _ = ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+					Signal     string
+					CoreDumped bool
+					Error      string
+					Lang       string
+				}{Signal: "KILL"}))
+				return
+			}
+			fmt.Fprintln(ch, payload.Value)
+			_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+			return
+
+		case "subsystem":
+			_ = ssh.Unmarshal(req.Payload, &payload)
+			if payload.Value != "sftp" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+			server, err := sftp.NewServer(ch)
+			if err != nil {
+				return
+			}
+			_ = server.Serve()
+			_ = server.Close()
+			return
+
+		default:
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// drop closes every connection to the server
+func (s *testSSHServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, nc := range s.conns {
+		nc.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testSSHServer) dialCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dials
+}
+
+func (s *testSSHServer) Close() {
+	s.ln.Close()
+	s.drop()
+}
+
+// runTransportCmd runs a command on the transport and returns its output
+func runTransportCmd(tr Transport, shellCmd string) (string, error) {
+	cmd, err := tr.Command(shellCmd)
+	if err != nil {
+		return "", err
+	}
+	defer cmd.Close()
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	out, err := ioutil.ReadAll(stdout)
+	if err != nil {
+		return "", err
+	}
+	return string(out), cmd.Wait()
+}
+
+func TestSSHTransportRedial(t *testing.T) {
+
+	s := newTestSSHServer(t)
+	defer s.Close()
+
+	tr, err := DialSSHTransport(s.dialConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	if out, err := runTransportCmd(tr, "hello"); err != nil || out != "hello\n" {
+		t.Fatalf("unexpected result: %q, %v", out, err)
+	}
+
+	// A command in flight when the connection drops fails with a *ConnectionLostError
+	errc := make(chan error, 1)
+	go func() {
+		_, err := runTransportCmd(tr, "hang")
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	s.drop()
+
+	select {
+	case err := <-errc:
+		var lostErr *ConnectionLostError
+		if !errors.As(err, &lostErr) {
+			t.Errorf("expected a *ConnectionLostError, received %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("command still running after the connection was dropped")
+	}
+
+	// The next command redials
+	if out, err := runTransportCmd(tr, "again"); err != nil || out != "again\n" {
+		t.Fatalf("unexpected result: %q, %v", out, err)
+	}
+	if n := s.dialCount(); n != 2 {
+		t.Errorf("expected 2 connections, received %d", n)
+	}
+}
+
+func TestSSHTransportConcurrentRedial(t *testing.T) {
+
+	s := newTestSSHServer(t)
+	defer s.Close()
+
+	tr, err := DialSSHTransport(s.dialConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	s.drop()
+	time.Sleep(50 * time.Millisecond)
+
+	// Operations finding the connection lost share a single redial
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := runTransportCmd(tr, fmt.Sprint(i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := s.dialCount(); n != 2 {
+		t.Errorf("expected 2 connections, received %d", n)
+	}
+}
+
+func TestSSHTransportCloseDuringRedial(t *testing.T) {
+
+	s := newTestSSHServer(t)
+
+	cfg := s.dialConfig()
+	cfg.MinBackoff = time.Minute
+	cfg.MaxBackoff = time.Minute
+	tr, err := DialSSHTransport(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Redialing fails and backs off for a long time
+	s.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	// Operations wait for the redial without holding up Close
+	errc := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := tr.Command("hello")
+			errc <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s to close", elapsed)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errc:
+			if err != errTransportClosed {
+				t.Errorf("expected %v, received %v", errTransportClosed, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("redial not interrupted by Close")
+		}
+	}
+}
+
+func TestSSHTransportOrdinaryError(t *testing.T) {
+
+	s := newTestSSHServer(t)
+	defer s.Close()
+
+	tr, err := DialSSHTransport(s.dialConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	// Prime the SFTP session
+	if _, err := tr.Stat(os.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	// An error that doesn't suggest a lost connection is returned straight away
+	start := time.Now()
+	_, err = tr.Stat(os.TempDir() + "/udt-no-such-file")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected %v, received %v", os.ErrNotExist, err)
+	}
+	if elapsed := time.Since(start); elapsed >= lostGracePeriod {
+		t.Errorf("took %s to fail", elapsed)
+	}
+}
+
+func TestSSHTransportKeepalive(t *testing.T) {
+
+	s := newTestSSHServer(t)
+	defer s.Close()
+
+	cfg := s.dialConfig()
+	cfg.KeepaliveInterval = 20 * time.Millisecond
+	cfg.KeepaliveTimeout = 50 * time.Millisecond
+	tr, err := DialSSHTransport(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	// An unanswered keepalive marks the connection lost, without anything else failing
+	atomic.StoreInt32(&s.ignoreKeepalives, 1)
+
+	st := tr.(*sshTransport)
+	st.mu.Lock()
+	conn := st.conn
+	st.mu.Unlock()
+
+	select {
+	case <-conn.lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not marked lost after an unanswered keepalive")
+	}
+
+	// The next operation redials
+	atomic.StoreInt32(&s.ignoreKeepalives, 0)
+	if out, err := runTransportCmd(tr, "hello"); err != nil || out != "hello\n" {
+		t.Fatalf("unexpected result: %q, %v", out, err)
+	}
+	if n := s.dialCount(); n != 2 {
+		t.Errorf("expected 2 connections, received %d", n)
+	}
+}
+
+func TestSSHTransportSFTPReopen(t *testing.T) {
+
+	s := newTestSSHServer(t)
+	defer s.Close()
+
+	tr, err := DialSSHTransport(s.dialConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	dir, err := ioutil.TempDir("", "udt-sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := tr.Create(dir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("contents")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The SFTP session dies with the connection and is reopened on a new one
+	s.drop()
+
+	r, err := tr.Open(dir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(buf) != "contents" {
+		t.Fatalf("unexpected result: %q, %v", buf, err)
+	}
+	if n := s.dialCount(); n != 2 {
+		t.Errorf("expected 2 connections, received %d", n)
+	}
+}
+
+func TestSSHTransportExitSignal(t *testing.T) {
+
+	s := newTestSSHServer(t)
+	defer s.Close()
+
+	tr, err := DialSSHTransport(s.dialConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	// A command terminated by a signal has a status of -1, as it does with the local transport
+	_, err = runTransportCmd(tr, "killed")
+	if status, ok := exitStatus(err); !ok || status != -1 {
+		t.Errorf("expected exit status -1, received %d (%v)", status, err)
+	}
+}
@@ -24,6 +24,11 @@ type truncReader struct {
 func (r *truncReader) Read(p []byte) (int, error) {
 
 	for i := 0; i < len(p); i++ {
+		// Return what we have rather than block waiting for more data
+		if i > 0 && r.r.Buffered() <= len(r.searchPattern) {
+			return i, nil
+		}
+
 		buf, err := r.r.Peek(len(r.searchPattern) + 1)
 		if len(buf) == 0 || err == bufio.ErrBufferFull {
 			return i, err
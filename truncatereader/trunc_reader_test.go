@@ -54,6 +54,23 @@ func TestNewTruncReader(t *testing.T) {
 	}
 }
 
+func TestTruncReaderPartial(t *testing.T) {
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	r := NewTruncReader(pr, []byte("xy"))
+
+	go pw.Write([]byte("abcdef"))
+
+	// Everything but the last len(pattern) bytes can be read before the stream ends
+	buf := make([]byte, 16)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, []byte("abcd"), buf[:n], "partial read")
+}
+
 func benchHelper(b *testing.B, N int64, patternSize int) {
 	b.Helper()
 
@@ -1,66 +1,345 @@
 package udt
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/pkg/sftp"
 	"github.com/samhug/udt/truncatereader"
-	"golang.org/x/crypto/ssh"
+	"golang.org/x/text/encoding"
 )
 
-// EnvConfig holds configuration info for a UDT client
+// EnvConfig holds configuration info for a UDT client. Blank fields are discovered by NewClient,
+// see DiscoverEnv.
 type EnvConfig struct {
 	UdtBin  string
 	UdtHome string
 	UdtAcct string
 }
 
-// NewClient creates a udt.Client object from the provided SSH client
-func NewClient(client *ssh.Client, env *EnvConfig) *Client {
+// NewClient creates a udt.Client object that accesses the database host through the provided
+// Transport. Use NewSSHTransport for a remote host or NewLocalTransport when running on the
+// database host itself.
+//
+// Blank fields of env (which may be nil) are discovered by probing the host, and the environment
+// is checked before the client is returned; see DiscoverEnv.
+func NewClient(transport Transport, env *EnvConfig, opts ...ClientOption) (*Client, error) {
+	return NewClientContext(context.Background(), transport, env, opts...)
+}
+
+// NewClientContext is like NewClient but gives up on probing the host if ctx is done
+func NewClientContext(ctx context.Context, transport Transport, env *EnvConfig, opts ...ClientOption) (*Client, error) {
 
-	if env.UdtAcct == "" {
-		panic("udt.NewClient: env.UdtAcct must not be blank")
+	c := &Client{
+		transport:           transport,
+		logger:              nopLogger{},
+		observer:            nopObserver{},
+		phantomPollInterval: defaultPhantomPollInterval,
+		phantomsHeld:        make(map[*PhantomProc]struct{}),
+		detectErrors:        true,
 	}
-	if env.UdtBin == "" {
-		panic("udt.NewClient: env.UdtBin must not be blank")
+
+	for _, opt := range opts {
+		opt(c)
 	}
-	if env.UdtHome == "" {
-		panic("udt.NewClient: env.UdtHome must not be blank")
+
+	env, err := c.discoverEnv(ctx, env)
+	if err != nil {
+		return nil, fmt.Errorf("udt.NewClient: %w", err)
 	}
+	c.env = env
 
-	c := &Client{
-		env:       env,
-		sshClient: client,
+	return c, nil
+}
+
+// ClientOption configures optional behaviour of a Client
+type ClientOption func(*Client)
+
+// WithLogger sets the Logger that receives the client's diagnostic messages
+func WithLogger(logger Logger) ClientOption {
+	return func(c *Client) {
+		if logger == nil {
+			logger = nopLogger{}
+		}
+		c.logger = logger
+	}
+}
+
+// WithObserver sets the Observer notified of the client's operations
+func WithObserver(observer Observer) ClientOption {
+	return func(c *Client) {
+		if observer == nil {
+			observer = nopObserver{}
+		}
+		c.observer = observer
+	}
+}
+
+// WithMaxSessions limits the number of commands the client runs on the database host at once.
+// Further commands wait, in the order they were issued, for a running command to finish. SSH
+// servers limit the number of sessions per connection (MaxSessions in sshd_config), and the SSH
+// transport keeps one session open for SFTP, so n should be at most one less than that limit.
+// A value of 0 means no limit.
+func WithMaxSessions(n int) ClientOption {
+	return func(c *Client) {
+		c.sessions = newSemaphore(n)
 	}
+}
 
-	return c
+// WithMaxPhantoms limits the number of PHANTOM processes the client has running at once. A PHANTOM
+// started with ExecutePhantomAsync counts towards the limit until WaitPhantom returns for it.
+// Further launches wait, in the order they were issued, for a running PHANTOM to finish. A value
+// of 0 means no limit.
+func WithMaxPhantoms(n int) ClientOption {
+	return func(c *Client) {
+		c.phantoms = newSemaphore(n)
+	}
 }
 
-// Client represents a Unidata database client
+// WithPhantomPolling sets how often WaitPhantom checks whether a PHANTOM process has completed,
+// and how long it waits in total before giving up. The defaults are every 500ms with no time limit.
+// A PHANTOM process that doesn't complete within the timeout is killed as if the context passed to
+// WaitPhantomContext were done.
+func WithPhantomPolling(interval, timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		if interval <= 0 {
+			interval = defaultPhantomPollInterval
+		}
+		c.phantomPollInterval = interval
+		c.phantomTimeout = timeout
+	}
+}
+
+const defaultPhantomPollInterval = 500 * time.Millisecond
+
+// Client represents a Unidata database client. A Client is safe for concurrent use by multiple
+// goroutines.
 type Client struct {
 	env       *EnvConfig
-	sshClient *ssh.Client
+	transport Transport
+	logger    Logger
+	observer  Observer
+
+	sessions *semaphore
+	phantoms *semaphore
+
+	phantomPollInterval time.Duration
+	phantomTimeout      time.Duration
+
+	// encoding is the character encoding used by the database, or nil if it hasn't been set
+	encoding encoding.Encoding
+
+	detectErrors bool
+
+	// phantomsHeld holds the PHANTOM processes started by this client that are holding a phantoms slot
+	phantomsMu   sync.Mutex
+	phantomsHeld map[*PhantomProc]struct{}
+}
+
+// command prepares shellCmd to be run on the database host, waiting for a free session if the
+// number of sessions is limited. The command must be waited on or closed to free its session.
+func (c *Client) command(ctx context.Context, shellCmd string) (Cmd, error) {
+	if err := c.sessions.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	cmd, err := c.transport.Command(shellCmd)
+	if err != nil {
+		c.sessions.release()
+		c.logger.LogCommand(shellCmd, 0, err)
+		return nil, err
+	}
+	return &trackedCmd{Cmd: cmd, client: c, ctx: ctx, shellCmd: shellCmd}, nil
 }
 
-// UdtProc represents a PHANTOM process running on the database
+// holdPhantom takes a phantoms slot for proc, a PHANTOM process this client didn't launch, so that
+// it counts towards the limit until releasePhantom
+func (c *Client) holdPhantom(ctx context.Context, proc *PhantomProc) error {
+	if err := c.phantoms.acquire(ctx); err != nil {
+		return err
+	}
+	c.phantomsMu.Lock()
+	c.phantomsHeld[proc] = struct{}{}
+	c.phantomsMu.Unlock()
+	return nil
+}
+
+// releasePhantom frees the phantoms slot held by proc, if it holds one
+func (c *Client) releasePhantom(proc *PhantomProc) {
+	c.phantomsMu.Lock()
+	_, held := c.phantomsHeld[proc]
+	delete(c.phantomsHeld, proc)
+	c.phantomsMu.Unlock()
+
+	if held {
+		c.phantoms.release()
+	}
+}
+
+// openFile opens the file at path on the database host for reading. The transfer is reported to the
+// client's Observer when the file is closed.
+func (c *Client) openFile(ctx context.Context, path string) (io.ReadCloser, error) {
+	_, obs := c.startOp(ctx, OpTransfer, path)
+	f, err := c.transport.Open(path)
+	if err != nil {
+		obs.end(err)
+		return nil, err
+	}
+	return newHookedCloser(&observedReader{f, obs}, func() error {
+		err := f.Close()
+		obs.end(err)
+		return err
+	}), nil
+}
+
+// writeFile creates or truncates the file at path on the database host and writes data to it
+func (c *Client) writeFile(ctx context.Context, path string, data []byte) (err error) {
+	_, obs := c.startOp(ctx, OpTransfer, path)
+	defer func() { obs.end(err) }()
+
+	f, err := c.transport.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create file (%s): %w", path, err)
+	}
+
+	n, err := f.Write(data)
+	obs.addBytes(n)
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("error writing to file (%s): %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing file (%s): %w", path, err)
+	}
+	return nil
+}
+
+// Close releases the resources held by the client's Transport. The client must not be used after
+// it has been closed.
+func (c *Client) Close() error {
+	return c.transport.Close()
+}
+
+// UdtProc represents a udt process running on the database host. Its methods mirror those of
+// os/exec.Cmd.
 type UdtProc struct {
-	Stdout  io.Reader
-	session *ssh.Session
+	Stdout io.Reader
+
+	// Stderr is buffered in the background, so leaving it unread doesn't hold up the process
+	Stderr io.Reader
+
+	// Stdin is connected to the process's standard input when it was started by ExecuteInteractive,
+	// otherwise it is nil and the process reads end-of-file
+	Stdin io.WriteCloser
+
+	cmd Cmd
+
+	ctx      context.Context
+	done     chan struct{}
+	doneOnce sync.Once
+
+	start    time.Time
+	waitOnce sync.Once
+	waitErr  error
+
+	// mu guards the outcome of the process, which is read while Wait may be running
+	mu       sync.Mutex
+	exited   bool
+	exitCode int
+	duration time.Duration
 }
 
-// Wait waits for the process to complete
+// Wait waits for the process to complete. A non-zero exit status is reported as an *ExitError. If
+// the context the process was started with is done before the process exits, Wait returns the
+// context's error.
 func (p *UdtProc) Wait() error {
-	return p.session.Wait()
+	p.waitOnce.Do(func() {
+		err := p.cmd.Wait()
+		duration := time.Since(p.start)
+		p.stopWatch()
+
+		exitCode := -1
+		if err == nil {
+			exitCode = 0
+		} else if code, ok := exitStatus(err); ok {
+			exitCode = code
+			err = &ExitError{ExitCode: code, Err: err}
+		}
+
+		p.mu.Lock()
+		p.exited, p.exitCode, p.duration = true, exitCode, duration
+		p.mu.Unlock()
+
+		if err != nil && p.ctx.Err() != nil {
+			err = p.ctx.Err()
+		}
+		p.waitErr = err
+	})
+	return p.waitErr
+}
+
+// Output reads the process's standard output until it ends, waits for the process to exit and
+// returns the output. If the process exits with a non-zero status the returned *ExitError holds
+// its standard error output.
+func (p *UdtProc) Output() ([]byte, error) {
+	out, readErr := ioutil.ReadAll(p.Stdout)
+	stderr, _ := ioutil.ReadAll(p.Stderr)
+
+	err := p.Wait()
+	if exitErr, ok := err.(*ExitError); ok {
+		exitErr.Stderr = stderr
+	}
+	if err == nil && readErr != nil {
+		err = fmt.Errorf("failed to read stdout: %w", readErr)
+	}
+	return out, err
 }
 
-// Close closes the underlying session
+// ExitCode returns the exit status of the process, or -1 if it hasn't exited or was terminated by
+// a signal
+func (p *UdtProc) ExitCode() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.exitCode
+}
+
+// Duration returns the wall time the process ran for, or has been running for if Wait hasn't
+// returned yet
+func (p *UdtProc) Duration() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.exited {
+		return p.duration
+	}
+	return time.Since(p.start)
+}
+
+// Close closes the underlying command
 func (p *UdtProc) Close() error {
-	return p.session.Close()
+	p.stopWatch()
+	return p.cmd.Close()
+}
+
+// watch kills the process if the context is done before the process exits
+func (p *UdtProc) watch() {
+	select {
+	case <-p.ctx.Done():
+		_ = p.cmd.Kill()
+	case <-p.done:
+	}
+}
+
+func (p *UdtProc) stopWatch() {
+	p.doneOnce.Do(func() { close(p.done) })
 }
 
 // PhantomProc represents a PHANTOM process running on the database
@@ -70,39 +349,68 @@ type PhantomProc struct {
 }
 
 // ExecutePhantomAsync runs the provided unidata command as a PHANTOM process
-func (c *Client) ExecutePhantomAsync(cmd string) (_ *PhantomProc, err error) {
+func (c *Client) ExecutePhantomAsync(cmd string) (*PhantomProc, error) {
+	return c.ExecutePhantomAsyncContext(context.Background(), cmd)
+}
+
+// ExecutePhantomAsyncContext is like ExecutePhantomAsync but gives up on launching the PHANTOM
+// process if ctx is done before udt reports that it has started.
+func (c *Client) ExecutePhantomAsyncContext(ctx context.Context, cmd string) (_ *PhantomProc, err error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := c.phantoms.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			c.phantoms.release()
+		}
+	}()
 
-	// Open a new SSH session
-	session, err := c.sshClient.NewSession()
+	ctx, obs := c.startOp(ctx, OpPhantomLaunch, cmd)
+	defer func() { obs.end(err) }()
+
+	encoded, err := c.encodeString(cmd)
+	if err != nil {
+		return nil, err
+	}
+	shellCmd := c.udtShellCmd("PHANTOM", encoded)
+
+	remoteCmd, err := c.command(ctx, shellCmd)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create SSH session: %s", err)
+		return nil, err
 	}
-	defer safeCloseIgnoreEOF(session, "failed to close SSH session", &err)
+	defer safeClose(remoteCmd, "failed to close command", &err)
 
 	// Get an io.Reader for stderr
-	outputPipe, err := session.StderrPipe()
+	outputPipe, err := remoteCmd.StderrPipe()
 	if err != nil {
-		return nil, fmt.Errorf("failed to attach to SSH stderr pipe: %s", err)
+		return nil, fmt.Errorf("failed to attach to stderr pipe: %s", err)
 	}
 
-	// TODO: Fix shell escaping here, strconv.Quote is for escaping Go string literals not shell commands
-	shellCmd := fmt.Sprintf("UDTHOME=%s;UDTBIN=%s; cd %s; $UDTBIN/udt PHANTOM %s",
-		strconv.Quote(c.env.UdtHome),
-		strconv.Quote(c.env.UdtBin),
-		strconv.Quote(c.env.UdtAcct),
-		strconv.Quote(cmd),
-	)
-	if err := session.Run(shellCmd); err != nil {
-		outputBuf, _ := ioutil.ReadAll(outputPipe)
-		return nil, fmt.Errorf("udt execute failed for command '%s'\n===\n%s\n===\n%s", shellCmd, outputBuf, err)
+	// Collect the output while the command runs
+	outputc := make(chan readResult, 1)
+	go func() {
+		buf, err := ioutil.ReadAll(outputPipe)
+		outputc <- readResult{buf, err}
+	}()
+
+	if err := runCmd(ctx, remoteCmd); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		res := <-outputc
+		return nil, &CommandError{Command: shellCmd, Output: string(res.buf), Err: err}
 	}
 
-	// Collect the output
-	outputBuf, err := ioutil.ReadAll(outputPipe)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read UDT stderr output: %s", err)
+	res := <-outputc
+	if res.err != nil {
+		return nil, fmt.Errorf("failed to read UDT stderr output: %s", res.err)
 	}
-	output := string(outputBuf)
+	output := string(res.buf)
 
 	// We're expecting output of the form:
 	//
@@ -112,187 +420,396 @@ func (c *Client) ExecutePhantomAsync(cmd string) (_ *PhantomProc, err error) {
 	re := regexp.MustCompile("PHANTOM process (\\d+) started\\.\nCOMO file is '(.+)'\\.")
 	match := re.FindStringSubmatch(output)
 	if match == nil || len(match) != 3 {
-		return nil, fmt.Errorf("error parsing UDT stderr output:\n===\n%s\n===\n%s", output, err)
+		return nil, &CommandError{Command: shellCmd, Output: output, Err: ErrPhantomStartParse}
 	}
 	pid, err := strconv.Atoi(match[1])
 	if err != nil {
-		panic("ExecutePhantomAsync: surely a sign of the end times...")
+		return nil, &CommandError{Command: shellCmd, Output: output, Err: fmt.Errorf("%w: %s", ErrPhantomStartParse, err)}
 	}
 
-	return &PhantomProc{
+	proc := &PhantomProc{
 		Pid:     pid,
 		OutFile: fmt.Sprintf("%s/%s", c.env.UdtAcct, match[2]),
-	}, nil
+	}
+
+	c.phantomsMu.Lock()
+	c.phantomsHeld[proc] = struct{}{}
+	c.phantomsMu.Unlock()
+
+	return proc, nil
 }
 
-// WaitPhantom will block until the specified PHANTOM process terminates
-func (c *Client) WaitPhantom(proc *PhantomProc) (err error) {
+// WaitPhantom will block until the specified PHANTOM process completes. Completion is detected by
+// polling for the trailer udt writes at the end of the COMO file ("PHANTOM process N has
+// completed."), so the output is complete once WaitPhantom returns. A process that exits without
+// writing the trailer is reported with ErrPhantomIncomplete. See WithPhantomPolling.
+func (c *Client) WaitPhantom(proc *PhantomProc) error {
+	return c.WaitPhantomContext(context.Background(), proc)
+}
 
-	// Open a new SSH session
-	session, err := c.sshClient.NewSession()
-	if err != nil {
-		return fmt.Errorf("failed to create SSH session: %s", err)
+// WaitPhantomContext is like WaitPhantom but if ctx is done before the PHANTOM process terminates,
+// the process is killed, its COMO file is removed and the context's error is returned.
+func (c *Client) WaitPhantomContext(ctx context.Context, proc *PhantomProc) (err error) {
+
+	defer c.releasePhantom(proc)
+
+	if err := ctx.Err(); err != nil {
+		c.abandonPhantom(proc)
+		return err
+	}
+
+	ctx, obs := c.startOp(ctx, OpPhantomWait, strconv.Itoa(proc.Pid))
+	defer func() { obs.end(err) }()
+
+	waitCtx := ctx
+	if c.phantomTimeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, c.phantomTimeout)
+		defer cancel()
 	}
-	defer safeCloseIgnoreEOF(session, "failed to close SSH session", &err)
 
-	if err := session.Run(fmt.Sprintf("/usr/bin/wait %d", proc.Pid)); err != nil {
-		// If the error is an exit status of 127, ignore it. That just means the PID wasn't found
-		if err, ok := err.(*ssh.ExitError); !ok || err.ExitStatus() != 127 {
-			return fmt.Errorf("error waiting for process to terminate: %s", err)
+	// giveUp kills the process once waitCtx is done
+	giveUp := func() error {
+		c.abandonPhantom(proc)
+		if ctx.Err() == nil {
+			return fmt.Errorf("PHANTOM process %d did not complete within %s: %w", proc.Pid, c.phantomTimeout, waitCtx.Err())
 		}
+		return ctx.Err()
 	}
 
-	return nil
+	for {
+		state, err := c.phantomState(waitCtx, proc)
+		if err != nil {
+			if waitCtx.Err() != nil {
+				return giveUp()
+			}
+			return fmt.Errorf("error waiting for process to terminate: %w", err)
+		}
+
+		switch state {
+		case phantomCompleted:
+			return nil
+		case phantomExited:
+			return fmt.Errorf("PHANTOM process %d: %w", proc.Pid, ErrPhantomIncomplete)
+		}
+
+		select {
+		case <-time.After(c.phantomPollInterval):
+		case <-waitCtx.Done():
+			return giveUp()
+		}
+	}
 }
 
+type phantomStatus string
+
+const (
+	phantomRunning   phantomStatus = "running"
+	phantomCompleted phantomStatus = "completed"
+	phantomExited    phantomStatus = "exited"
+)
+
+// phantomState checks whether a PHANTOM process has completed its COMO file, is still running, or
+// has exited without completing it. The COMO file is checked again after finding the process gone
+// in case it completed in between.
+func (c *Client) phantomState(ctx context.Context, proc *PhantomProc) (phantomStatus, error) {
+	script := fmt.Sprintf(`pid=%d; como=%s; trailer=%s
+if grep -F -q "$trailer" "$como" 2>/dev/null; then echo %s
+elif ps -p "$pid" >/dev/null 2>&1; then echo %s
+elif grep -F -q "$trailer" "$como" 2>/dev/null; then echo %s
+else echo %s
+fi`,
+		proc.Pid, shellQuote(proc.OutFile), shellQuote(phantomTrailer(proc.Pid)),
+		phantomCompleted, phantomRunning, phantomCompleted, phantomExited,
+	)
+
+	out, err := c.shellOutput(ctx, script)
+	if err != nil {
+		return "", err
+	}
+
+	switch state := phantomStatus(strings.TrimSpace(out)); state {
+	case phantomRunning, phantomCompleted, phantomExited:
+		return state, nil
+	}
+	return "", &CommandError{Command: script, Output: out, Err: errors.New("unexpected response")}
+}
+
+// phantomTrailer is the line udt writes at the end of a PHANTOM process's COMO file
+func phantomTrailer(pid int) string {
+	return fmt.Sprintf("PHANTOM process %d has completed.", pid)
+}
+
+// Execute runs the provided unidata command and returns a UdtProc attached to its output
+//
+// If the output starts with a UniData error message reading Stdout fails with a *UniDataError, see
+// WithErrorDetection.
 func (c *Client) Execute(cmd string) (*UdtProc, error) {
+	return c.ExecuteContext(context.Background(), cmd)
+}
 
-	// Open a new SSH session
-	session, err := c.sshClient.NewSession()
+// ExecuteContext is like Execute but the udt process is killed if ctx is done before it exits.
+func (c *Client) ExecuteContext(ctx context.Context, cmd string) (*UdtProc, error) {
+	return c.execute(ctx, cmd, false)
+}
+
+// ExecuteInteractive is like Execute but connects the process's standard input to proc.Stdin, so
+// that prompts for input can be answered. See UdtProc.Respond for answering them automatically.
+func (c *Client) ExecuteInteractive(cmd string) (*UdtProc, error) {
+	return c.ExecuteInteractiveContext(context.Background(), cmd)
+}
+
+// ExecuteInteractiveContext is like ExecuteInteractive but the process is killed if ctx is done
+// before it exits
+func (c *Client) ExecuteInteractiveContext(ctx context.Context, cmd string) (*UdtProc, error) {
+	return c.execute(ctx, cmd, true)
+}
+
+func (c *Client) execute(ctx context.Context, cmd string, interactive bool) (*UdtProc, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	encoded, err := c.encodeString(cmd)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create SSH session: %s", err)
+		return nil, err
+	}
+	shellCmd := c.udtShellCmd(encoded)
+
+	remoteCmd, err := c.command(ctx, shellCmd)
+	if err != nil {
+		return nil, err
 	}
 
 	udtProc := UdtProc{
-		session: session,
+		cmd:      remoteCmd,
+		ctx:      ctx,
+		done:     make(chan struct{}),
+		exitCode: -1,
+	}
+
+	if interactive {
+		stdin, err := remoteCmd.StdinPipe()
+		if err != nil {
+			remoteCmd.Close()
+			return nil, fmt.Errorf("failed to attach to stdin pipe: %s", err)
+		}
+		udtProc.Stdin = c.encodeWriter(stdin)
 	}
 
 	// Get an io.Reader for stdout
-	udtProc.Stdout, err = session.StdoutPipe()
+	stdout, err := remoteCmd.StdoutPipe()
 	if err != nil {
-		session.Close()
-		return nil, fmt.Errorf("failed to attach to SSH stdout pipe: %s", err)
+		remoteCmd.Close()
+		return nil, fmt.Errorf("failed to attach to stdout pipe: %s", err)
+	}
+	udtProc.Stdout = c.decodeReader(stdout)
+	if !interactive {
+		udtProc.Stdout = c.classifyReader(cmd, udtProc.Stdout)
 	}
 
-	// TODO: Fix shell escaping here, strconv.Quote is for escaping Go string literals not shell commands
-	shellCmd := fmt.Sprintf("UDTHOME=%s;UDTBIN=%s; cd %s; $UDTBIN/udt %s",
-		strconv.Quote(c.env.UdtHome),
-		strconv.Quote(c.env.UdtBin),
-		strconv.Quote(c.env.UdtAcct),
-		strconv.Quote(cmd),
-	)
-	if err := session.Start(shellCmd); err != nil {
-		session.Close()
-		return nil, fmt.Errorf("Failed to start command '%s'\n===\n%s", shellCmd, err)
+	stderr, err := remoteCmd.StderrPipe()
+	if err != nil {
+		remoteCmd.Close()
+		return nil, fmt.Errorf("failed to attach to stderr pipe: %s", err)
+	}
+
+	udtProc.start = time.Now()
+	if err := remoteCmd.Start(); err != nil {
+		remoteCmd.Close()
+		return nil, &CommandError{Command: shellCmd, Err: err}
 	}
+	udtProc.Stderr = newBufferedReader(c.decodeReader(stderr))
+	go udtProc.watch()
 
 	return &udtProc, nil
 }
 
 // ExecutePhantom runs the provided unidata command as a PHANTOM process, waits for it to complete, and returns a reader with output
+//
+// If the output starts with a UniData error message a *UniDataError is returned instead, see
+// WithErrorDetection.
 func (c *Client) ExecutePhantom(cmd string) (io.ReadCloser, error) {
+	return c.ExecutePhantomContext(context.Background(), cmd)
+}
+
+// ExecutePhantomContext is like ExecutePhantom but the PHANTOM process is killed and its COMO file
+// removed if ctx is done before it completes. Reads from the returned reader fail once ctx is done.
+func (c *Client) ExecutePhantomContext(ctx context.Context, cmd string) (io.ReadCloser, error) {
+	r, err := c.executePhantom(ctx, cmd, true)
+	if err != nil {
+		return nil, err
+	}
+	return c.checkOutput(cmd, r)
+}
+
+// executePhantom runs cmd as a PHANTOM process and returns its output, decoded with the client's
+// encoding if decode is set
+func (c *Client) executePhantom(ctx context.Context, cmd string, decode bool) (io.ReadCloser, error) {
 
-	proc, err := c.ExecutePhantomAsync(cmd)
+	proc, err := c.ExecutePhantomAsyncContext(ctx, cmd)
 	if err != nil {
-		return nil, fmt.Errorf("ExecutePhantomAsync failed: %s", err)
+		return nil, fmt.Errorf("ExecutePhantomAsync failed: %w", err)
 	}
 
-	if err := c.WaitPhantom(proc); err != nil {
-		return nil, fmt.Errorf("WaitPhantom failed: %s", err)
+	if err := c.WaitPhantomContext(ctx, proc); err != nil {
+		return nil, fmt.Errorf("WaitPhantom failed: %w", err)
 	}
 
-	r, err := c.RetrieveOutput(proc)
+	r, err := c.retrieveOutput(ctx, proc, decode)
 	if err != nil {
-		return nil, fmt.Errorf("RetrieveOutput failed: %s", err)
+		return nil, fmt.Errorf("RetrieveOutput failed: %w", err)
 	}
 
 	return r, nil
 }
 
-// CompileBasicProgram uploads BASIC source code to the UDT server and compiles it
-func (c *Client) CompileBasicProgram(progFile string, progName string, progSrc string) (err error) {
+// CompileBasicProgram uploads BASIC source code to the UDT server and compiles it. It fails with
+// ErrProgramExists if the program's source already exists, see CompileBasicProgramWithOptions for
+// replacing it. The uploaded source is removed again if it fails to compile.
+func (c *Client) CompileBasicProgram(progFile string, progName string, progSrc string) error {
+	return c.CompileBasicProgramContext(context.Background(), progFile, progName, progSrc)
+}
+
+// CompileBasicProgramContext is like CompileBasicProgram but abandons the compile if ctx is done
+// first. The uploaded source file is removed when the compile is abandoned.
+func (c *Client) CompileBasicProgramContext(ctx context.Context, progFile string, progName string, progSrc string) error {
+	_, err := c.CompileBasicProgramDiagnosticsContext(ctx, progFile, progName, progSrc)
+	return err
+}
+
+// CompileBasicProgramDiagnostics is like CompileBasicProgram but also returns the warnings from a
+// successful compile. When the compile fails the diagnostics are in the returned *CompileError.
+func (c *Client) CompileBasicProgramDiagnostics(progFile string, progName string, progSrc string) ([]CompileDiagnostic, error) {
+	return c.CompileBasicProgramDiagnosticsContext(context.Background(), progFile, progName, progSrc)
+}
+
+// CompileBasicProgramDiagnosticsContext is like CompileBasicProgramDiagnostics but abandons the
+// compile if ctx is done first
+func (c *Client) CompileBasicProgramDiagnosticsContext(ctx context.Context, progFile string, progName string, progSrc string) ([]CompileDiagnostic, error) {
+	return c.CompileBasicProgramWithOptionsContext(ctx, progFile, progName, progSrc, UploadOptions{})
+}
+
+// CompileBasicProgramWithOptions is like CompileBasicProgramDiagnostics but opts control what
+// happens to existing source of the same name
+func (c *Client) CompileBasicProgramWithOptions(progFile string, progName string, progSrc string, opts UploadOptions) ([]CompileDiagnostic, error) {
+	return c.CompileBasicProgramWithOptionsContext(context.Background(), progFile, progName, progSrc, opts)
+}
 
-	//TODO: Assert that progFile is a directory that already exists
-	//TODO: Assert that the target file doesn't already exist
+// CompileBasicProgramWithOptionsContext is like CompileBasicProgramWithOptions but abandons the
+// compile if ctx is done first. The previous source is restored when the compile is abandoned.
+func (c *Client) CompileBasicProgramWithOptionsContext(ctx context.Context, progFile string, progName string, progSrc string, opts UploadOptions) (_ []CompileDiagnostic, err error) {
 
 	if progFile == "" {
-		return fmt.Errorf("progFile must not be blank")
+		return nil, fmt.Errorf("progFile must not be blank")
 	}
 	if progName == "" {
-		return fmt.Errorf("progName must not be blank")
+		return nil, fmt.Errorf("progName must not be blank")
 	}
 
-	// Initialize SFTP client
-	client, err := sftp.NewClient(c.sshClient)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ctx, obs := c.startOp(ctx, OpCompile, progFile+" "+progName)
+	defer func() { obs.end(err) }()
+
+	src, err := c.encodeString(progSrc)
 	if err != nil {
-		return fmt.Errorf("failed to initialize SFTP client: %s", err)
+		return nil, fmt.Errorf("failed to encode BASIC source: %w", err)
 	}
-	defer safeClose(client, "failed to close SFTP client", &err)
 
-	srcPath := c.env.UdtAcct + "/" + progFile + "/" + progName
-	f, err := client.Create(srcPath)
+	upload, err := c.uploadSource(ctx, progFile, progName, []byte(src), opts)
 	if err != nil {
-		return fmt.Errorf("failed to create BASIC source file (%s): %s", srcPath, err)
+		return nil, err
 	}
 
-	if _, err := f.Write([]byte(progSrc)); err != nil {
-		_ = f.Close()
-		return fmt.Errorf("error writing to BASIC source file (%s): %s", srcPath, err)
+	diags, err := c.compileSource(ctx, progFile, progName)
+	if err != nil {
+		if rollbackErr := upload.rollback(); rollbackErr != nil {
+			return nil, fmt.Errorf("%w (restoring the previous source failed: %s)", err, rollbackErr)
+		}
+		return nil, err
 	}
-	if err := f.Close(); err != nil {
-		return fmt.Errorf("error closing BASIC source file (%s): %s", srcPath, err)
+
+	if err := upload.commit(); err != nil {
+		return diags, err
 	}
+	return diags, nil
+}
 
-	r, err := c.ExecutePhantom("BASIC " + progFile + " " + progName)
+// compileSource compiles a program whose source has been uploaded
+func (c *Client) compileSource(ctx context.Context, progFile string, progName string) (_ []CompileDiagnostic, err error) {
+
+	r, err := c.executePhantom(ctx, "BASIC "+progFile+" "+progName, true)
 	if err != nil {
-		return fmt.Errorf("failed to compile BASIC program: %s", err)
+		return nil, fmt.Errorf("failed to compile BASIC program: %w", err)
 	}
 	defer safeClose(r, "failed to close BASIC compile response reader", &err)
 
 	buf, err := ioutil.ReadAll(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Expecting output of the form: "\nCompiling Unibasic: BP/testProg in mode 'u'.\ncompilation finished\n"
 	re := regexp.MustCompile(`\ncompilation finished\n`)
 	if matched := re.Match(buf); !matched {
-		return fmt.Errorf("unexpected response when compiling BASIC program:\n%s", buf)
+		return nil, &CompileError{ProgFile: progFile, ProgName: progName, Output: string(buf), Diagnostics: parseCompileDiagnostics(string(buf))}
 	}
 
-	return nil
+	return parseCompileDiagnostics(string(buf)), nil
 }
 
-// DeleteBasicProgram deletes the named BASIC program from the UDT server
-func (c *Client) DeleteBasicProgram(progFile string, progName string) (err error) {
+// DeleteBasicProgram deletes the named BASIC program's source and object code from the UDT server. A
+// program that has never been compiled has no object code, which is not an error.
+func (c *Client) DeleteBasicProgram(progFile string, progName string) error {
+	return c.DeleteBasicProgramContext(context.Background(), progFile, progName)
+}
+
+// DeleteBasicProgramContext is like DeleteBasicProgram but returns early if ctx is already done
+func (c *Client) DeleteBasicProgramContext(ctx context.Context, progFile string, progName string) (err error) {
 
 	if progFile == "" {
-		panic("progFile must not be blank")
+		return fmt.Errorf("progFile must not be blank")
 	}
 	if progName == "" {
-		panic("progName must not be blank")
+		return fmt.Errorf("progName must not be blank")
 	}
 
-	// Initialize SFTP client
-	client, err := sftp.NewClient(c.sshClient)
-	if err != nil {
-		return fmt.Errorf("failed to initialize SFTP client: %s", err)
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	defer safeClose(client, "failed to close SFTP client", &err)
 
 	binPath := c.env.UdtAcct + "/" + progFile + "/_" + progName
-	if err := client.Remove(binPath); err != nil {
-		return fmt.Errorf("failed to delete BASIC program file (%s): %s", binPath, err)
+	if err := c.transport.Remove(binPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete BASIC program file (%s): %w", binPath, err)
 	}
 
 	srcPath := c.env.UdtAcct + "/" + progFile + "/" + progName
-	if err := client.Remove(srcPath); err != nil {
-		return fmt.Errorf("failed to delete BASIC source file (%s): %s", srcPath, err)
+	if err := c.transport.Remove(srcPath); err != nil {
+		return fmt.Errorf("failed to delete BASIC source file (%s): %w", srcPath, err)
 	}
 
 	return nil
 }
 
 // SavedListDelete deletes a saved list from the UDT server
-func (c *Client) SavedListDelete(savedListName string) (err error) {
+func (c *Client) SavedListDelete(savedListName string) error {
+	return c.SavedListDeleteContext(context.Background(), savedListName)
+}
+
+// SavedListDeleteContext is like SavedListDelete but abandons the PHANTOM process if ctx is done first
+func (c *Client) SavedListDeleteContext(ctx context.Context, savedListName string) (err error) {
 
 	if savedListName == "" {
-		panic("savedListName must not be blank")
+		return fmt.Errorf("savedListName must not be blank")
 	}
 
-	r, err := c.ExecutePhantom("DELETELIST '" + savedListName + "'")
+	r, err := c.ExecutePhantomContext(ctx, "DELETELIST '"+savedListName+"'")
 	if err != nil {
-		return fmt.Errorf("failed to delete UDT saved list (%s): %s", savedListName, err)
+		return fmt.Errorf("failed to delete UDT saved list (%s): %w", savedListName, err)
 	}
 	defer safeClose(r, "failed to close PHANTOM response reader", &err)
 
@@ -301,75 +818,92 @@ func (c *Client) SavedListDelete(savedListName string) (err error) {
 		return err
 	}
 
-	// Expecting output of the form: "'d5375b81-b09a-6a17-c182-04c272e5f71d' deleted.\n"
-	re := regexp.MustCompile(`'` + savedListName + `' deleted\.\n`)
-	if matched := re.Match(buf); !matched {
-		return fmt.Errorf("unexpected response when deleting saved list:\n%q", buf)
+	// Expecting output of the form "'d5375b81-b09a-6a17-c182-04c272e5f71d' deleted." or, when
+	// there is no such list, "'d5375b81-b09a-6a17-c182-04c272e5f71d' not found."
+	quoted := `'` + regexp.QuoteMeta(savedListName) + `'`
+	switch {
+	case regexp.MustCompile(`(?m)^` + quoted + ` deleted\.\r?$`).Match(buf):
+		return nil
+	case regexp.MustCompile(`(?m)^` + quoted + ` not found\.\r?$`).Match(buf):
+		return fmt.Errorf("failed to delete UDT saved list (%s): %w", savedListName, ErrSavedListNotFound)
 	}
-
-	return nil
+	return fmt.Errorf("unexpected response when deleting saved list:\n%q", buf)
 }
 
 // RetrieveAndDeleteFile returns a ReadCloser for the contents of the file at the given path.
 // path should be relative to UdtAcct. The file is deleted when Close() is called on the returned
 // ReadCloser.
-func (c *Client) RetrieveAndDeleteFile(path string) (_ io.ReadCloser, err error) {
+func (c *Client) RetrieveAndDeleteFile(path string) (io.ReadCloser, error) {
+	return c.RetrieveAndDeleteFileContext(context.Background(), path)
+}
 
-	// Initialize SFTP client
-	client, err := sftp.NewClient(c.sshClient)
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize SFTP client: %s", err)
+// RetrieveAndDeleteFileContext is like RetrieveAndDeleteFile but reads from the returned ReadCloser
+// fail once ctx is done. The file is still deleted when Close() is called.
+func (c *Client) RetrieveAndDeleteFileContext(ctx context.Context, path string) (_ io.ReadCloser, err error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
 	path = c.env.UdtAcct + "/" + path
 
 	// Open the specified file
-	f, err := client.Open(path)
+	f, err := c.openFile(ctx, path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file (%s): %s", path, err)
+		return nil, fmt.Errorf("failed to open file (%s): %w", path, err)
 	}
 
-	return newHookedCloser(f, func() (err error) {
-		defer safeClose(client, "failed to close SFTP client", &err)
+	return newHookedCloser(newContextReader(ctx, f), func() (err error) {
 		if err = f.Close(); err != nil {
 			return fmt.Errorf("error closing file: %s", err)
 		}
 
 		// Remove the file
-		if err = client.Remove(path); err != nil {
-			return fmt.Errorf("error removing file (%s): %s", path, err)
+		if err = c.transport.Remove(path); err != nil {
+			return fmt.Errorf("error removing file (%s): %w", path, err)
 		}
 		return nil
 	}), nil
 }
 
 // RetrieveOutput retrieves the output of the provided PhantomProc
-func (c *Client) RetrieveOutput(proc *PhantomProc) (_ io.ReadCloser, err error) {
+func (c *Client) RetrieveOutput(proc *PhantomProc) (io.ReadCloser, error) {
+	return c.RetrieveOutputContext(context.Background(), proc)
+}
 
-	// Initialize SFTP client
-	client, err := sftp.NewClient(c.sshClient)
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize SFTP client: %s", err)
+// RetrieveOutputContext is like RetrieveOutput but reads from the returned ReadCloser fail once
+// ctx is done. The COMO file is still removed when Close() is called.
+func (c *Client) RetrieveOutputContext(ctx context.Context, proc *PhantomProc) (io.ReadCloser, error) {
+	return c.retrieveOutput(ctx, proc, true)
+}
+
+// retrieveOutput opens the output of proc, decoding it with the client's encoding if decode is set
+func (c *Client) retrieveOutput(ctx context.Context, proc *PhantomProc, decode bool) (_ io.ReadCloser, err error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
 	// Retrieve COMO file and verify the command ran successfully
-	f, err := client.Open(proc.OutFile)
+	f, err := c.openFile(ctx, proc.OutFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open UDT output file (%s): %s", proc.OutFile, err)
+		return nil, fmt.Errorf("failed to open UDT output file (%s): %w", proc.OutFile, err)
 	}
 
 	// Pipe the PHANTOM output through a TruncReader to strip the last line of output
-	r := truncatereader.NewTruncReader(f, []byte(fmt.Sprintf("PHANTOM process %d has completed.\n", proc.Pid)))
+	r := truncatereader.NewTruncReader(newContextReader(ctx, f), []byte(phantomTrailer(proc.Pid)+"\n"))
+	if decode {
+		r = c.decodeReader(r)
+	}
 
 	return newHookedCloser(r, func() (err error) {
-		defer safeClose(client, "failed to close SFTP client", &err)
 		if err = f.Close(); err != nil {
 			return fmt.Errorf("error closing UDT output file: %s", err)
 		}
 
 		// Remove the COMO file
-		if err = client.Remove(proc.OutFile); err != nil {
-			return fmt.Errorf("error removing temporary COMO file (%s): %s", proc.OutFile, err)
+		if err = c.transport.Remove(proc.OutFile); err != nil {
+			return fmt.Errorf("error removing temporary COMO file (%s): %w", proc.OutFile, err)
 		}
 		return nil
 	}), nil
@@ -437,6 +971,138 @@ func QuoteString(str string) string {
 	return `'` + strings.Join(parts, `':"'":'`) + `'`
 }
 
+// abandonPhantom kills a PHANTOM process and removes its COMO file. It is used to clean up after an
+// operation has been cancelled so errors are ignored.
+func (c *Client) abandonPhantom(proc *PhantomProc) {
+	if cmd, err := c.command(context.Background(), fmt.Sprintf("kill -KILL %d", proc.Pid)); err == nil {
+		_ = runCmd(context.Background(), cmd)
+		_ = cmd.Close()
+	}
+	_ = c.transport.Remove(proc.OutFile)
+}
+
+// runCmd runs the command to completion. If ctx is done before the command exits, the command is
+// killed and the context's error is returned.
+func runCmd(ctx context.Context, cmd Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- cmd.Wait() }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		_ = cmd.Kill()
+		<-errc
+		return ctx.Err()
+	}
+}
+
+// shellOutput runs shellCmd on the database host and returns its standard output
+func (c *Client) shellOutput(ctx context.Context, shellCmd string) (_ string, err error) {
+	cmd, err := c.command(ctx, shellCmd)
+	if err != nil {
+		return "", err
+	}
+	defer safeClose(cmd, "failed to close command", &err)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", fmt.Errorf("failed to attach to stdout pipe: %s", err)
+	}
+
+	outputc := make(chan readResult, 1)
+	go func() {
+		buf, err := ioutil.ReadAll(stdout)
+		outputc <- readResult{buf, err}
+	}()
+
+	if err := runCmd(ctx, cmd); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", ctxErr
+		}
+		res := <-outputc
+		return "", &CommandError{Command: shellCmd, Output: string(res.buf), Err: err}
+	}
+
+	res := <-outputc
+	if res.err != nil {
+		return "", fmt.Errorf("failed to read stdout: %s", res.err)
+	}
+	return string(res.buf), nil
+}
+
+// bufferedReader reads r to completion in the background, buffering everything it reads, so that
+// whatever is writing to r is never held up by a slow or absent reader
+type bufferedReader struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	err  error
+}
+
+func newBufferedReader(r io.Reader) *bufferedReader {
+	b := &bufferedReader{}
+	b.cond = sync.NewCond(&b.mu)
+
+	go func() {
+		p := make([]byte, 4096)
+		for {
+			n, err := r.Read(p)
+
+			b.mu.Lock()
+			b.buf.Write(p[:n])
+			b.err = err
+			b.cond.Broadcast()
+			b.mu.Unlock()
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return b
+}
+
+func (b *bufferedReader) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.buf.Len() == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+	if b.buf.Len() > 0 {
+		return b.buf.Read(p)
+	}
+	return 0, b.err
+}
+
+type readResult struct {
+	buf []byte
+	err error
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// newContextReader returns a Reader that fails with the context's error once ctx is done
+func newContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx, r}
+}
+
 type hookedCloser struct {
 	io.Reader
 	closer func() error
@@ -450,17 +1116,21 @@ func newHookedCloser(r io.Reader, closer func() error) io.ReadCloser {
 	return &hookedCloser{r, closer}
 }
 
-func safeClose(c io.Closer, msg string, err *error) {
-	if cerr := c.Close(); cerr != nil && *err == nil {
-		*err = fmt.Errorf("%s: %s", msg, cerr)
-	}
+type hookedWriteCloser struct {
+	io.Writer
+	closer func() error
+}
+
+func (w *hookedWriteCloser) Close() error {
+	return w.closer()
 }
 
-func safeCloseIgnoreEOF(c io.Closer, msg string, err *error) {
-	// https://stackoverflow.com/questions/42590308/proper-way-to-close-a-crypto-ssh-session-freeing-all-resources-in-golang#comment72394178_42590388
-	// session.Close() will return io.EOF if called after session.WaitPhantom()/session.Run()
-	// we want to ignore the EOF
-	if cerr := c.Close(); cerr != nil && cerr != io.EOF && err == nil {
+func newHookedWriteCloser(w io.Writer, closer func() error) io.WriteCloser {
+	return &hookedWriteCloser{w, closer}
+}
+
+func safeClose(c io.Closer, msg string, err *error) {
+	if cerr := c.Close(); cerr != nil && *err == nil {
 		*err = fmt.Errorf("%s: %s", msg, cerr)
 	}
 }
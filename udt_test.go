@@ -0,0 +1,409 @@
+package udt
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeUdt is a stand-in for the udt binary. It understands just enough of the commands issued by a
+// Client to exercise it without a Unidata installation:
+//
+//	PHANTOM BASIC <file> <prog>  compiles a program, creating its object code
+//	PHANTOM SLEEP <seconds>      sleeps before completing the COMO file
+//	PHANTOM CRASH                exits without completing the COMO file
+//	PHANTOM DELETELIST '<name>'  deletes a saved list from SAVEDLISTS
+//	PHANTOM NOSTART              fails to start, printing a message that isn't understood
+//	PHANTOM <anything else>      echoes the statement to the COMO file
+//	RUN BP <prog> -N             acts as the QueryBatched agent, selecting 5 records and printing
+//	                             debug messages when the program sets DEBUG. Listing from BAD.SELECTED,
+//	                             BAD.COUNT, BAD.BATCH or BAD.PATH makes it print a malformed message.
+//	CLEAR.FILE <file>            asks for confirmation before "clearing" the file
+//	PAGED                        prints three pages, waiting for RETURN between them
+//	NOTAVERB                     complains that it is not a verb
+//	EXIT <status>                exits with the given status, complaining on stderr
+//	<anything else>              echoes the statement to stdout
+//
+// Run without a statement it reads statements from stdin after printing a ":" prompt, like an
+// interactive udt session, and additionally understands DISPLAY, SELECT, LIST, LOGTO, WHERE, SLEEP,
+// CLEAR.FILE and QUIT.
+const fakeUdt = `#!/bin/sh
+run_agent() {
+	batchsize=$(sed -n 's/^BATCHSIZE = //p' "BP/$1")
+	queryid=$(sed -n "s/^QUERYID = '\(.*\)'$/\1/p" "BP/$1")
+	debug=$(sed -n 's/^DEBUG = //p' "BP/$1")
+	listfile=$(sed -n "s/^LISTFILE = '\(.*\)'$/\1/p" "BP/$1")
+	count=5
+	case "$listfile" in
+	BAD.SELECTED) echo "|SELECTED"; return ;;
+	BAD.COUNT) echo "|SELECTED|many"; return ;;
+	BAD.BATCH) printf '|SELECTED|%d\n|RESULTBATCH|0\n' $count; return ;;
+	BAD.PATH) printf '|SELECTED|%d\n|RESULTBATCH|0|VOC\n' $count; return ;;
+	esac
+	if [ "$debug" -ge 1 ]; then
+		echo "|DEBUG|12345|selected $count records"
+		echo "stray agent output"
+	fi
+	echo "|SELECTED|$count"
+	batch=0
+	i=1
+	while [ $i -le $count ]; do
+		out="_XML_/${queryid}_$batch.xml"
+		{
+			echo '<?xml version="1.0"?>'
+			echo '<ROOT>'
+			n=0
+			while [ $n -lt $batchsize ] && [ $i -le $count ]; do
+				echo "<ORDERS _ID=\"$i\" ID=\"$i\"/>"
+				i=$((i+1))
+				n=$((n+1))
+			done
+			echo '</ROOT>'
+		} > "$out"
+		echo "|RESULTBATCH|$batch|$out"
+		batch=$((batch+1))
+	done
+	echo "|DONE"
+}
+
+interactive() {
+	echo "UniData Release 8.2 Build: (fake)"
+	list=""
+	while printf ':' && read -r line; do
+		set -- $line
+		case "$1" in
+		DISPLAY) shift; echo "$*" ;;
+		SELECT) list="$2"; echo; echo "5 records selected to list 0."; echo ;;
+		LIST)
+			if [ -n "$list" ]; then
+				echo "LIST $2 using the select list of $list"
+				list=""
+			else
+				echo "LIST $2"
+			fi
+			;;
+		LOGTO) cd "$2" || echo "Not a UniData account: $2" ;;
+		WHERE) pwd ;;
+		SLEEP) sleep "$2" ;;
+		CLEAR.FILE)
+			# The answer is recorded so tests can check what was given
+			printf "Do you want to clear %s? (Y/N) " "$2"
+			read -r answer
+			echo "$answer" > CLEAR.FILE.answer
+			echo "$2 not cleared."
+			;;
+		QUIT) exit 0 ;;
+		*) echo "$line" ;;
+		esac
+	done
+}
+
+case "$1" in
+"")
+	interactive
+	;;
+PHANTOM)
+	if [ "$2" = NOSTART ]; then
+		echo "Unable to start PHANTOM process." >&2
+		exit 0
+	fi
+	"$0" PHANTOM_CHILD "$2" </dev/null >/dev/null 2>&1 &
+	printf "PHANTOM process %d started.\nCOMO file is '_PH_/test%d_1'.\n" $! $! >&2
+	;;
+PHANTOM_CHILD)
+	como="_PH_/test$$_1"
+	set -- $2
+	case "$1" in
+	BASIC)
+		# Lines containing UNUSED draw a warning and lines containing SYNTAX an error
+		{
+			printf "\nCompiling Unibasic: %s/%s in mode 'u'.\n" "$2" "$3"
+			awk '/UNUSED/ { printf "Warning: Line %d: Variable UNUSED never assigned a value\n", NR }' "$2/$3"
+			awk '/SYNTAX/ { printf "main program: syntax error at or before\nLine %d, Column %d\n", NR, index($0, "SYNTAX") }' "$2/$3"
+		} > "$como"
+		if grep -q SYNTAX "$2/$3"; then
+			echo "compilation failed" >> "$como"
+		else
+			: > "$2/_$3"
+			echo "compilation finished" >> "$como"
+		fi
+		;;
+	SLEEP)
+		echo "sleeping" > "$como"
+		sleep "$2"
+		echo "slept" >> "$como"
+		;;
+	TICK)
+		: > "$como"
+		i=1
+		while [ "$i" -le "$2" ]; do echo "tick $i" >> "$como"; sleep 0.2; i=$((i+1)); done
+		;;
+	NOTAVERB)
+		printf "Not a verb\n%s\n" "$1" > "$como"
+		;;
+	LIST)
+		if [ "$2" = NOSUCHFILE ]; then
+			printf "Not a filename :\n%s\n" "$2" > "$como"
+		elif [ "$2" = VOC ]; then
+			# Catalog entries are kept in the VOC file as NAME|F1|F2 lines
+			{
+				echo '<?xml version="1.0"?>'
+				echo '<ROOT>'
+				while IFS='|' read -r name f1 f2; do echo "<VOC _ID=\"$name\" F2=\"$f2\"/>"; done < VOC
+				echo '</ROOT>'
+			} > "$como"
+		else
+			echo "$*" > "$como"
+		fi
+		;;
+	CATALOG)
+		if [ ! -f "$2/_$3" ]; then
+			echo "$2/_$3 not found." > "$como"
+		else
+			# VOC is keyed by name, so an entry is replaced
+			[ -f VOC ] && { grep -v "^$3|" VOC > VOC.tmp; mv VOC.tmp VOC; }
+			case "$4" in
+			LOCAL) mkdir -p CTLG; cp "$2/_$3" "CTLG/$3"; echo "$3|C|CTLG/$3" >> VOC ;;
+			DIRECT) echo "$3|C|$2/_$3" >> VOC ;;
+			*)
+				dir="$UDTHOME/sys/CTLG/$(echo "$3" | cut -c1 | tr 'A-Z' 'a-z')"
+				mkdir -p "$dir"; cp "$2/_$3" "$dir/$3"
+				;;
+			esac
+			echo "$3 has been cataloged." > "$como"
+		fi
+		;;
+	DELETE.CATALOG)
+		case "$3" in
+		LOCAL|DIRECT)
+			if grep -q "^$2|" VOC; then
+				grep -v "^$2|" VOC > VOC.tmp; mv VOC.tmp VOC; rm -f "CTLG/$2"
+				echo "$2 has been deleted." > "$como"
+			else
+				echo "$2 not cataloged." > "$como"
+			fi
+			;;
+		*)
+			if rm "$UDTHOME"/sys/CTLG/*/"$2" 2>/dev/null; then echo "$2 has been deleted." > "$como"; else echo "$2 not cataloged." > "$como"; fi
+			;;
+		esac
+		;;
+	DELETELIST)
+		name=$(echo "$2" | tr -d "'")
+		if [ ! -d SAVEDLISTS ]; then
+			echo "File SAVEDLISTS not found." > "$como"
+		elif [ -f "SAVEDLISTS/${name}000" ]; then
+			rm "SAVEDLISTS/${name}000"
+			echo "'$name' deleted." > "$como"
+		else
+			echo "'$name' not found." > "$como"
+		fi
+		;;
+	CRASH)
+		echo "crashing" > "$como"
+		exit 1
+		;;
+	*)
+		echo "$*" > "$como"
+		;;
+	esac
+	echo "PHANTOM process $$ has completed." >> "$como"
+	;;
+*)
+	set -- $1
+	case "$1" in
+	RUN) run_agent "$3" ;;
+	LISTUSER)
+		echo "UDTNO USRNBR UID USRNAME USRTYPE TTY IP-ADDRESS TIME DATE"
+		echo "1 $$ 1000 test udt pts/0 Console $(date '+%H:%M:%S %b %d %Y')"
+		ps -eo pid=,args= | while read -r pid args; do
+			case "$args" in
+			*PHANTOM_CHILD*) echo "2 $pid 1000 test phantom pts/0 Console $(date '+%H:%M:%S %b %d %Y')" ;;
+			esac
+		done
+		;;
+	CLEAR.FILE)
+		printf "Do you want to clear %s? (Y/N) " "$2"
+		read -r answer
+		if [ "$answer" = Y ]; then echo; echo "$2 cleared."; else echo; echo "$2 not cleared."; fi
+		;;
+	BYTES) printf '%s' "$2" | od -An -tx1 | tr -d ' \n'; echo ;;
+	NOTAVERB) printf "Not a verb\n%s\n" "$1" ;;
+	EXIT)
+		echo "exiting with $2" >&2
+		exit "$2"
+		;;
+	PAGED)
+		for page in 1 2 3; do
+			echo "page $page"
+			if [ $page -lt 3 ]; then printf "Press RETURN to continue..."; read -r answer; fi
+		done
+		;;
+	*) echo "$*" ;;
+	esac
+	;;
+esac
+`
+
+// newTestEnv lays out a fake Unidata installation in a temporary directory. The returned function
+// removes it.
+func newTestEnv(t *testing.T) (*EnvConfig, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "udt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := &EnvConfig{
+		UdtHome: dir,
+		UdtBin:  filepath.Join(dir, "bin"),
+		UdtAcct: filepath.Join(dir, "demo"),
+	}
+	for _, d := range []string{env.UdtBin, env.UdtAcct + "/BP", env.UdtAcct + "/_PH_", env.UdtAcct + "/_XML_"} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(env.UdtBin, "udt"), []byte(fakeUdt), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(env.UdtAcct, "VOC"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return env, func() { os.RemoveAll(dir) }
+}
+
+// newTestClient returns a Client using the local transport and a fake Unidata installation. PHANTOM
+// processes are polled frequently to keep the tests quick.
+func newTestClient(t *testing.T, opts ...ClientOption) (*Client, *EnvConfig, func()) {
+	t.Helper()
+
+	opts = append([]ClientOption{WithPhantomPolling(10*time.Millisecond, 0)}, opts...)
+
+	env, cleanup := newTestEnv(t)
+	c, err := NewClient(NewLocalTransport(), env, opts...)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return c, env, func() {
+		c.Close()
+		cleanup()
+	}
+}
+
+// assertDirEmpty fails the test if the directory contains any files
+func assertDirEmpty(t *testing.T, dir string) {
+	t.Helper()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("unexpected file left behind: %s", filepath.Join(dir, e.Name()))
+	}
+}
+
+func TestUdtProcOutput(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	proc, err := c.Execute("WHO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proc.ExitCode() != -1 {
+		t.Errorf("expected an exit code of -1 before the process exits, received %d", proc.ExitCode())
+	}
+	out, err := proc.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "WHO\n" {
+		t.Errorf("unexpected output: %q", out)
+	}
+	if proc.ExitCode() != 0 {
+		t.Errorf("expected an exit code of 0, received %d", proc.ExitCode())
+	}
+	if proc.Duration() <= 0 {
+		t.Errorf("expected a positive duration, received %s", proc.Duration())
+	}
+	proc.Close()
+
+	proc, err = c.Execute("EXIT 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	_, err = proc.Output()
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("expected an *ExitError, received %v", err)
+	}
+	if exitErr.ExitCode != 3 || proc.ExitCode() != 3 {
+		t.Errorf("expected an exit code of 3, received %d and %d", exitErr.ExitCode, proc.ExitCode())
+	}
+	if string(exitErr.Stderr) != "exiting with 3\n" {
+		t.Errorf("unexpected stderr: %q", exitErr.Stderr)
+	}
+}
+
+func TestUdtProcConcurrentDuration(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	proc, err := c.Execute("WHO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	// The outcome can be checked on from another goroutine while Wait runs
+	durations := make(chan time.Duration, 1)
+	go func() {
+		for proc.ExitCode() == -1 {
+		}
+		durations <- proc.Duration()
+	}()
+
+	if _, err := proc.Output(); err != nil {
+		t.Fatal(err)
+	}
+	if d := <-durations; d <= 0 || proc.Duration() != d {
+		t.Errorf("expected a fixed positive duration, received %s and %s", d, proc.Duration())
+	}
+}
+
+func TestUdtProcStdin(t *testing.T) {
+
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	proc, err := c.ExecuteInteractive("CLEAR.FILE ORDERS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	if _, err := io.WriteString(proc.Stdin, "Y\n"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := proc.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "Do you want to clear ORDERS? (Y/N) \nORDERS cleared.\n" {
+		t.Errorf("unexpected output: %q", out)
+	}
+}